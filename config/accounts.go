@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+)
+
+// Accounts 账号池中的账号凭证，格式与请求的Authorization相同，从ACCOUNTS（逗号或换行分隔）和ACCOUNTS_FILE（每行一个）读取
+var Accounts []string
+
+// AccountsAPIKey 使用账号池的请求凭证，配置了账号池时必须设置
+var AccountsAPIKey = os.Getenv("ACCOUNTS_API_KEY")
+
+// AccountStrategy 账号池选择账号的策略
+var AccountStrategy = stlval.Ternary(os.Getenv("ACCOUNT_STRATEGY") != "", os.Getenv("ACCOUNT_STRATEGY"), "round_robin")
+
+// AccountMaxAttempts 一个请求最多尝试的账号数
+var AccountMaxAttempts = 3
+
+// AccountUnauthorizedCooldown 账号凭证失效后的冷却时间
+var AccountUnauthorizedCooldown = 10 * time.Minute
+
+// AccountRetryBodyLimit 使用账号池时为了换账号重试而缓存的请求体大小上限，超过时不重试
+var AccountRetryBodyLimit int64 = 8 << 20
+
+func init() {
+	accounts := os.Getenv("ACCOUNTS")
+	if path := os.Getenv("ACCOUNTS_FILE"); path != "" {
+		accounts += "\n" + string(stlerr.MustWith(os.ReadFile(path)))
+	}
+	for _, account := range strings.FieldsFunc(accounts, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if account = strings.TrimSpace(account); account != "" && !strings.HasPrefix(account, "#") {
+			Accounts = append(Accounts, account)
+		}
+	}
+	if len(Accounts) > 0 && AccountsAPIKey == "" {
+		// 否则任何请求都能使用账号池中的账号
+		stlerr.Must(stlerr.Errorf("ACCOUNTS_API_KEY must be set when ACCOUNTS or ACCOUNTS_FILE is configured"))
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("ACCOUNT_MAX_ATTEMPTS")); err == nil && n > 0 {
+		AccountMaxAttempts = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("ACCOUNT_UNAUTHORIZED_COOLDOWN")); err == nil && d > 0 {
+		AccountUnauthorizedCooldown = d
+	}
+	if n, err := strconv.ParseInt(os.Getenv("ACCOUNT_RETRY_BODY_LIMIT"), 10, 64); err == nil && n >= 0 {
+		AccountRetryBodyLimit = n
+	}
+}
@@ -0,0 +1,17 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// ImageURLAllowedHosts 允许服务端下载图片的域名，为空时允许所有公网地址
+var ImageURLAllowedHosts []string
+
+func init() {
+	for _, host := range strings.Split(os.Getenv("IMAGE_URL_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			ImageURLAllowedHosts = append(ImageURLAllowedHosts, host)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package config
+
+import (
+	"os"
+	"strconv"
+)
+
+// MaxChoices 一次聊天补全请求最多生成的回复数，避免单个请求占用账号过多的并发生成
+var MaxChoices = 4
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("MAX_CHOICES")); err == nil && n > 0 {
+		MaxChoices = n
+	}
+}
@@ -0,0 +1,10 @@
+package config
+
+import (
+	"os"
+
+	stlval "github.com/kkkunny/stl/value"
+)
+
+// DataDir 运行时数据（会话映射、上传和生成的文件、cookie缓存等）所在目录
+var DataDir = stlval.Ternary(os.Getenv("DATA_DIR") != "", os.Getenv("DATA_DIR"), "config")
@@ -0,0 +1,15 @@
+package config
+
+import (
+	"os"
+	"strconv"
+)
+
+// MaxImages 一次图片生成请求最多生成的图片数，每张图片占用一次并发生成
+var MaxImages = 4
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("MAX_IMAGES")); err == nil && n > 0 {
+		MaxImages = n
+	}
+}
@@ -0,0 +1,7 @@
+package config
+
+import "os"
+
+// OllamaAuthorization Ollama接口的请求没有携带Authorization时使用的凭证，Ollama客户端不会发送Authorization请求头。
+// 格式与Authorization相同，设置为ACCOUNTS_API_KEY时使用账号池
+var OllamaAuthorization = os.Getenv("OLLAMA_AUTHORIZATION")
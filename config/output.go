@@ -0,0 +1,6 @@
+package config
+
+import "os"
+
+// OutputSigningKey 生成文件代理地址的签名密钥，为空时随机生成并保存在DataDir中
+var OutputSigningKey = os.Getenv("OUTPUT_SIGNING_KEY")
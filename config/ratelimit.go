@@ -0,0 +1,21 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// RateLimitCooldown 账号被限流但HuggingChat没有给出恢复时间时的冷却时间
+var RateLimitCooldown = time.Minute
+
+// QuotaCooldown 账号额度用尽但HuggingChat没有给出恢复时间时的冷却时间
+var QuotaCooldown = time.Hour
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("RATE_LIMIT_COOLDOWN")); err == nil && d > 0 {
+		RateLimitCooldown = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("QUOTA_COOLDOWN")); err == nil && d > 0 {
+		QuotaCooldown = d
+	}
+}
@@ -0,0 +1,21 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// ReasoningMode 推理内容的默认输出方式
+var ReasoningMode = strings.TrimSpace(os.Getenv("REASONING_MODE"))
+
+// ModelReasoningModes 按模型指定推理内容的输出方式，格式为model=mode,model=mode
+var ModelReasoningModes = make(map[string]string)
+
+func init() {
+	for _, item := range strings.Split(os.Getenv("MODEL_REASONING_MODES"), ",") {
+		model, mode, ok := strings.Cut(item, "=")
+		if model, mode = strings.TrimSpace(model), strings.TrimSpace(mode); ok && model != "" && mode != "" {
+			ModelReasoningModes[model] = mode
+		}
+	}
+}
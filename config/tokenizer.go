@@ -0,0 +1,11 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+
+	stlval "github.com/kkkunny/stl/value"
+)
+
+// TokenizerDir 分词器文件所在目录
+var TokenizerDir = stlval.Ternary(os.Getenv("TOKENIZER_DIR") != "", os.Getenv("TOKENIZER_DIR"), filepath.Join(DataDir, "tokenizers"))
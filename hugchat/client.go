@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	stlslices "github.com/kkkunny/stl/container/slices"
 	"github.com/kkkunny/stl/container/tuple"
 	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
 
 	"github.com/kkkunny/HuggingChatAPI/config"
 	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
@@ -26,8 +29,12 @@ func NewClient(tokenProvider TokenProvider) *Client {
 	}
 }
 
-func (c *Client) handleUnauthorized(ctx context.Context, f func() error) error {
-	err := f()
+func (c *Client) handleUnauthorized(ctx context.Context, f func() error) (err error) {
+	defer func() {
+		c.recordLimit(err)
+	}()
+
+	err = f()
 	if !errors.Is(err, api.ErrUnauthorized) {
 		return err
 	}
@@ -38,6 +45,44 @@ func (c *Client) handleUnauthorized(ctx context.Context, f func() error) error {
 	return f()
 }
 
+// Account 客户端使用的账号
+func (c *Client) Account() string {
+	return c.tokenProvider.Account()
+}
+
+// CooldownUntil 账号因限流或额度用尽而冷却的截止时间
+func (c *Client) CooldownUntil() (time.Time, bool) {
+	return CooldownUntil(c.Account())
+}
+
+// checkCooldown 账号冷却中时直接返回限流错误，不再请求HuggingChat
+func (c *Client) checkCooldown() error {
+	cooldown, ok := globalCooldownStore.Get(c.Account())
+	if !ok {
+		return nil
+	}
+	return stlerr.ErrorWrap(&api.Error{
+		Kind:       cooldown.Kind,
+		Message:    fmt.Sprintf("account is cooling down until %s: %s", cooldown.Until.Format(time.RFC3339), cooldown.Message),
+		RetryAfter: time.Until(cooldown.Until),
+	})
+}
+
+// recordLimit 遇到限流或额度用尽时让账号冷却到预计的恢复时间
+func (c *Client) recordLimit(err error) {
+	apiErr, ok := api.AsError(err)
+	if !ok || !apiErr.IsLimited() {
+		return
+	}
+	until := time.Now().Add(apiErr.RetryAfter)
+	_ = config.Logger.Warnf("account `%s` is limited until %s: %s", c.Account(), until.Format(time.RFC3339), apiErr.Message)
+	globalCooldownStore.Set(c.Account(), &accountCooldown{
+		Kind:    apiErr.Kind,
+		Message: apiErr.Message,
+		Until:   until,
+	})
+}
+
 // ListModels 列出模型
 func (c *Client) ListModels(ctx context.Context) ([]*dto.ModelInfo, error) {
 	token, err := c.tokenProvider.GetToken(ctx)
@@ -57,6 +102,25 @@ func (c *Client) ListModels(ctx context.Context) ([]*dto.ModelInfo, error) {
 	}), nil
 }
 
+// ListTools 列出可用的工具
+func (c *Client) ListTools(ctx context.Context) ([]*dto.ToolInfo, error) {
+	token, err := c.tokenProvider.GetToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tools []*api.ToolInfo
+	err = c.handleUnauthorized(ctx, func() error {
+		tools, err = api.ListTools(ctx, token)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stlslices.Map(tools, func(_ int, tool *api.ToolInfo) *dto.ToolInfo {
+		return dto.NewToolInfoFromAPI(tool)
+	}), nil
+}
+
 // ListConversations 列出会话
 func (c *Client) ListConversations(ctx context.Context) ([]*dto.SimpleConversationInfo, error) {
 	token, err := c.tokenProvider.GetToken(ctx)
@@ -92,6 +156,9 @@ func (c *Client) ConversationInfo(ctx context.Context, convID string) (*dto.Conv
 
 // CreateConversation 创建会话
 func (c *Client) CreateConversation(ctx context.Context, model string, systemPrompt string) (*dto.ConversationInfo, error) {
+	if err := c.checkCooldown(); err != nil {
+		return nil, err
+	}
 	token, err := c.tokenProvider.GetToken(ctx)
 	if err != nil {
 		return nil, err
@@ -127,14 +194,59 @@ func (c *Client) DeleteConversation(ctx context.Context, convID string) error {
 	})
 }
 
+// StopGenerating 停止会话中正在进行的生成
+func (c *Client) StopGenerating(ctx context.Context, convID string) error {
+	token, err := c.tokenProvider.GetToken(ctx)
+	if err != nil {
+		return err
+	}
+	return c.handleUnauthorized(ctx, func() error {
+		return api.StopGenerating(ctx, token, convID)
+	})
+}
+
+// ConversationOutput 下载会话中生成的文件，返回文件内容和MIME类型
+func (c *Client) ConversationOutput(ctx context.Context, convID string, sha string) ([]byte, string, error) {
+	token, err := c.tokenProvider.GetToken(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	var data []byte
+	var mime string
+	err = c.handleUnauthorized(ctx, func() error {
+		data, mime, err = api.ConversationOutput(ctx, token, convID, sha)
+		return err
+	})
+	return data, mime, err
+}
+
+// streamMessageError HuggingChat在消息流中返回的错误，限流和额度用尽会被识别为对应的错误
+func streamMessageError(msg *dto.StreamMessage) error {
+	isErr := msg.Type == dto.StreamMessageTypeError ||
+		(msg.Type == dto.StreamMessageTypeStatus && stlval.DerefPtrOr(msg.Status) == dto.StreamMessageStatusError)
+	if !isErr {
+		return nil
+	}
+	text := stlval.DerefPtrOr(msg.Message)
+	if limitErr, ok := api.ParseLimitMessage(text); ok {
+		return stlerr.ErrorWrap(limitErr)
+	}
+	return stlerr.ErrorWrap(&api.Error{Kind: api.ErrorKindUpstreamError, Message: stlval.Ternary(text != "", text, "stream error")})
+}
+
 type ChatConversationParams struct {
 	LastMsgID string
 	Inputs    string
+	IsRetry   bool
 	WebSearch bool
 	Tools     []string
+	Files     []*dto.ConversationFile
 }
 
 func (c *Client) ChatConversation(ctx context.Context, convID string, params *ChatConversationParams) (chan *dto.StreamMessage, error) {
+	if err := c.checkCooldown(); err != nil {
+		return nil, err
+	}
 	token, err := c.tokenProvider.GetToken(ctx)
 	if err != nil {
 		return nil, err
@@ -145,8 +257,12 @@ func (c *Client) ChatConversation(ctx context.Context, convID string, params *Ch
 			ConversationID: convID,
 			ID:             params.LastMsgID,
 			Inputs:         params.Inputs,
+			IsRetry:        params.IsRetry,
 			WebSearch:      params.WebSearch,
 			Tools:          params.Tools,
+			Files: stlslices.Map(params.Files, func(_ int, file *dto.ConversationFile) *api.ChatConversationFile {
+				return file.ToAPI()
+			}),
 		})
 		return err
 	})
@@ -171,7 +287,10 @@ func (c *Client) ChatConversation(ctx context.Context, convID string, params *Ch
 			if err != nil && errors.Is(err, io.EOF) {
 				break
 			} else if err != nil {
-				msgChan <- &dto.StreamMessage{Type: dto.StreamMessageTypeError, Error: err}
+				select {
+				case msgChan <- &dto.StreamMessage{Type: dto.StreamMessageTypeError, Error: err}:
+				case <-ctx.Done():
+				}
 				break
 			}
 			data = strings.TrimSpace(data)
@@ -180,13 +299,22 @@ func (c *Client) ChatConversation(ctx context.Context, convID string, params *Ch
 			}
 
 			var msg dto.StreamMessage
-			err = stlerr.ErrorWrap(json.Unmarshal([]byte(data), &msg))
+			if err = json.Unmarshal([]byte(data), &msg); err != nil {
+				err = stlerr.ErrorWrap(&api.Error{Kind: api.ErrorKindParseFailure, Message: "parse stream message error: " + err.Error()})
+				msg = dto.StreamMessage{Type: dto.StreamMessageTypeError, Error: err}
+			} else if err = streamMessageError(&msg); err != nil {
+				c.recordLimit(err)
+				msg = dto.StreamMessage{Type: dto.StreamMessageTypeError, Error: err}
+			}
+
+			select {
+			case msgChan <- &msg:
+			case <-ctx.Done():
+				return
+			}
 			if err != nil {
-				msgChan <- &dto.StreamMessage{Type: dto.StreamMessageTypeError, Error: err}
 				break
 			}
-
-			msgChan <- &msg
 		}
 	}()
 	return msgChan, nil
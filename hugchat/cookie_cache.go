@@ -9,9 +9,11 @@ import (
 	"sync"
 
 	stlerr "github.com/kkkunny/stl/error"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
 )
 
-const cookieCachePath = "config/cookies.json"
+var cookieCachePath = filepath.Join(config.DataDir, "cookies.json")
 
 var globalCookieCache *cookieCache
 
@@ -0,0 +1,61 @@
+package hugchat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kkkunny/HuggingChatAPI/internal/api"
+)
+
+var globalCooldownStore = newCooldownStore()
+
+// CooldownUntil 账号因限流或额度用尽而冷却的截止时间，account为TokenProvider.Account()
+func CooldownUntil(account string) (time.Time, bool) {
+	cooldown, ok := globalCooldownStore.Get(account)
+	if !ok {
+		return time.Time{}, false
+	}
+	return cooldown.Until, true
+}
+
+// accountCooldown 账号被限流或额度用尽后的冷却状态
+type accountCooldown struct {
+	Kind    api.ErrorKind
+	Message string
+	Until   time.Time
+}
+
+// cooldownStore 保存在内存中的账号冷却状态
+type cooldownStore struct {
+	lock sync.Mutex
+	data map[string]*accountCooldown
+}
+
+func newCooldownStore() *cooldownStore {
+	return &cooldownStore{data: make(map[string]*accountCooldown)}
+}
+
+func (store *cooldownStore) Get(account string) (*accountCooldown, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	cooldown, ok := store.data[account]
+	if !ok {
+		return nil, false
+	} else if !time.Now().Before(cooldown.Until) {
+		delete(store.data, account)
+		return nil, false
+	}
+	return cooldown, true
+}
+
+// Set 设置冷却状态，已有更晚的恢复时间时保留原状态
+func (store *cooldownStore) Set(account string, cooldown *accountCooldown) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if exist, ok := store.data[account]; ok && exist.Until.After(cooldown.Until) {
+		return
+	}
+	store.data[account] = cooldown
+}
@@ -0,0 +1,23 @@
+package dto
+
+import (
+	"encoding/base64"
+
+	"github.com/kkkunny/HuggingChatAPI/internal/api"
+)
+
+// ConversationFile 随消息上传的文件
+type ConversationFile struct {
+	Name string
+	MIME string
+	Data []byte
+}
+
+func (file *ConversationFile) ToAPI() *api.ChatConversationFile {
+	return &api.ChatConversationFile{
+		Type:  "base64",
+		Value: base64.StdEncoding.EncodeToString(file.Data),
+		Mime:  file.MIME,
+		Name:  file.Name,
+	}
+}
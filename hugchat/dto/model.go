@@ -1,6 +1,8 @@
 package dto
 
 import (
+	"strings"
+
 	"github.com/kkkunny/HuggingChatAPI/internal/api"
 )
 
@@ -11,6 +13,9 @@ type ModelInfo struct {
 	Desc         string
 	MaxNewTokens int64
 	Active       bool
+	Multimodal   bool
+	// AcceptedMimeTypes 可以随消息上传的文件类型，支持image/*形式的通配
+	AcceptedMimeTypes []string
 }
 
 func NewModelInfoFromAPI(model *api.ModelInfo) *ModelInfo {
@@ -23,5 +28,21 @@ func NewModelInfoFromAPI(model *api.ModelInfo) *ModelInfo {
 		Desc:         model.Desc,
 		MaxNewTokens: model.MaxNewTokens,
 		Active:       model.Active,
+		Multimodal:   model.Multimodal,
+
+		AcceptedMimeTypes: model.AcceptedMimeTypes,
+	}
+}
+
+// Accepts 是否可以随消息上传该类型的文件
+func (model *ModelInfo) Accepts(mimeType string) bool {
+	for _, accepted := range model.AcceptedMimeTypes {
+		if accepted == mimeType || accepted == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(accepted, "/*"); ok && strings.HasPrefix(mimeType, prefix+"/") {
+			return true
+		}
 	}
+	return false
 }
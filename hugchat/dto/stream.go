@@ -1,19 +1,24 @@
 package dto
 
+import "fmt"
+
 type StreamMessage struct {
-	Type    StreamMessageType      `json:"type"`
-	SubType *StreamMessageSubType  `json:"subtype,omitempty"` // only StreamMessageTypeTool
-	UUID    *string                `json:"uuid,omitempty"`    // only StreamMessageTypeTool
-	Eta     *float64               `json:"eta,omitempty"`     // only StreamMessageTypeTool && StreamMessageSubTypeEta
-	Call    *StreamMessageToolCall `json:"call,omitempty"`    // only StreamMessageTypeTool && (StreamMessageSubTypeCall || StreamMessageSubTypeResult)
-	Status  *StreamMessageStatus   `json:"status,omitempty"`  // only StreamMessageTypeStatus || (StreamMessageTypeTool && StreamMessageSubTypeResult)
-	Token   *string                `json:"token,omitempty"`   // only StreamMessageTypeStream
-	Text    *string                `json:"text,omitempty"`    // only StreamMessageTypeFinalAnswer
-	Message *string                `json:"message,omitempty"` // only StreamMessageTypeStatus && StreamMessageStatusTitle
-	Error   error                  `json:"-"`                 // only StreamMessageTypeError
-	Name    *string                `json:"name,omitempty"`    // only StreamMessageTypeFile
-	SHA     *string                `json:"sha,omitempty"`     // only StreamMessageTypeFile
-	MIME    *string                `json:"mime,omitempty"`    // only StreamMessageTypeFile
+	Type    StreamMessageType        `json:"type"`
+	SubType *StreamMessageSubType    `json:"subtype,omitempty"` // only StreamMessageTypeTool || StreamMessageTypeWebSearch
+	UUID    *string                  `json:"uuid,omitempty"`    // only StreamMessageTypeTool
+	Eta     *float64                 `json:"eta,omitempty"`     // only StreamMessageTypeTool && StreamMessageSubTypeEta
+	Call    *StreamMessageToolCall   `json:"call,omitempty"`    // only StreamMessageTypeTool && (StreamMessageSubTypeCall || StreamMessageSubTypeResult)
+	Status  *StreamMessageStatus     `json:"status,omitempty"`  // only StreamMessageTypeStatus || (StreamMessageTypeTool && StreamMessageSubTypeResult)
+	Result  *StreamMessageToolResult `json:"result,omitempty"`  // only StreamMessageTypeTool && StreamMessageSubTypeResult
+	Token   *string                  `json:"token,omitempty"`   // only StreamMessageTypeStream
+	Text    *string                  `json:"text,omitempty"`    // only StreamMessageTypeFinalAnswer
+	Message *string                  `json:"message,omitempty"` // only (StreamMessageTypeStatus && StreamMessageStatusTitle) || StreamMessageTypeWebSearch || (StreamMessageTypeTool && StreamMessageSubTypeError)
+	Args    []string                 `json:"args,omitempty"`    // only StreamMessageTypeWebSearch && StreamMessageSubTypeUpdate
+	Sources []*WebSearchSource       `json:"sources,omitempty"` // only StreamMessageTypeWebSearch && StreamMessageSubTypeSources
+	Error   error                    `json:"-"`                 // only StreamMessageTypeError
+	Name    *string                  `json:"name,omitempty"`    // only StreamMessageTypeFile
+	SHA     *string                  `json:"sha,omitempty"`     // only StreamMessageTypeFile
+	MIME    *string                  `json:"mime,omitempty"`    // only StreamMessageTypeFile
 }
 
 type StreamMessageType string
@@ -27,6 +32,7 @@ const (
 	StreamMessageTypeFile        StreamMessageType = "file"
 	StreamMessageTypeTitle       StreamMessageType = "title"
 	StreamMessageTypeReasoning   StreamMessageType = "reasoning"
+	StreamMessageTypeWebSearch   StreamMessageType = "webSearch"
 )
 
 type StreamMessageSubType string
@@ -35,17 +41,46 @@ const (
 	StreamMessageSubTypeCall   StreamMessageSubType = "call"
 	StreamMessageSubTypeEta    StreamMessageSubType = "eta"
 	StreamMessageSubTypeResult StreamMessageSubType = "result"
+
+	StreamMessageSubTypeUpdate   StreamMessageSubType = "update"   // 网络搜索进度
+	StreamMessageSubTypeError    StreamMessageSubType = "error"    // 工具调用或网络搜索出错
+	StreamMessageSubTypeSources  StreamMessageSubType = "sources"  // 网络搜索来源
+	StreamMessageSubTypeFinished StreamMessageSubType = "finished" // 网络搜索完成
 )
 
+// WebSearchSource 网络搜索来源
+type WebSearchSource struct {
+	Link     string `json:"link"`
+	Title    string `json:"title"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
 type StreamMessageToolCall struct {
 	Name       string                     `json:"name"`
 	Parameters StreamMessageToolParameter `json:"parameters"`
 }
 
-type StreamMessageToolParameter struct {
-	Prompt string `json:"prompt"`
-	Width  string `json:"width"`
-	Height string `json:"height"`
+// StreamMessageToolParameter 工具调用参数，不同工具的参数各不相同
+type StreamMessageToolParameter map[string]any
+
+// String 获取字符串类型的参数，参数不存在时返回空字符串
+func (params StreamMessageToolParameter) String(key string) string {
+	switch v := params[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// StreamMessageToolResult 工具调用结果
+type StreamMessageToolResult struct {
+	Status  StreamMessageStatus    `json:"status"`
+	Call    *StreamMessageToolCall `json:"call,omitempty"`
+	Outputs []map[string]any       `json:"outputs,omitempty"`
+	Message string                 `json:"message,omitempty"`
 }
 
 type StreamMessageStatus string
@@ -55,4 +90,5 @@ const (
 	StreamMessageStatusTitle     StreamMessageStatus = "title"
 	StreamMessageStatusSuccess   StreamMessageStatus = "success"
 	StreamMessageStatusKeepAlive StreamMessageStatus = "keepAlive"
+	StreamMessageStatusError     StreamMessageStatus = "error"
 )
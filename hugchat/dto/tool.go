@@ -0,0 +1,27 @@
+package dto
+
+import (
+	"github.com/kkkunny/HuggingChatAPI/internal/api"
+)
+
+// ToolInfo 工具信息
+type ToolInfo struct {
+	ID          string
+	Name        string
+	DisplayName string
+	Desc        string
+	Type        string
+}
+
+func NewToolInfoFromAPI(tool *api.ToolInfo) *ToolInfo {
+	if tool == nil {
+		return nil
+	}
+	return &ToolInfo{
+		ID:          tool.ID,
+		Name:        tool.Name,
+		DisplayName: tool.DisplayName,
+		Desc:        tool.Description,
+		Type:        tool.Type,
+	}
+}
@@ -2,6 +2,8 @@ package hugchat
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 
@@ -16,6 +18,7 @@ const tokenCookieKey = "hf-chat"
 var RefreshTokenError = fmt.Errorf("refresh token error")
 
 type TokenProvider interface {
+	Account() string // 账号标识，用于记录账号的冷却状态
 	RefreshToken(ctx context.Context) ([]*http.Cookie, error)
 	GetToken(ctx context.Context) ([]*http.Cookie, error)
 }
@@ -28,6 +31,11 @@ func NewDirectTokenProvider(token string) TokenProvider {
 	return &directTokenProvider{token: token}
 }
 
+func (p *directTokenProvider) Account() string {
+	sum := sha256.Sum256([]byte(p.token))
+	return "token:" + hex.EncodeToString(sum[:8])
+}
+
 func (p *directTokenProvider) RefreshToken(_ context.Context) ([]*http.Cookie, error) {
 	return nil, stlerr.ErrorWrap(RefreshTokenError)
 }
@@ -45,6 +53,10 @@ func NewAccountTokenProvider(usr, pwd string) TokenProvider {
 	return &accountTokenProvider{username: usr, password: pwd}
 }
 
+func (p *accountTokenProvider) Account() string {
+	return p.username
+}
+
 func (p *accountTokenProvider) RefreshToken(ctx context.Context) ([]*http.Cookie, error) {
 	token, err := api.Login(ctx, p.username, p.password)
 	if err != nil {
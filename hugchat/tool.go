@@ -0,0 +1,6 @@
+package hugchat
+
+// HuggingChat内置工具ID
+const (
+	ToolImageGeneration = "000000000000000000000001"
+)
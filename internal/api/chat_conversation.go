@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 
 	request "github.com/imroc/req/v3"
@@ -13,15 +15,22 @@ import (
 	"github.com/kkkunny/HuggingChatAPI/config"
 )
 
+type ChatConversationFile struct {
+	Type  string `json:"type"` // base64 or hash
+	Value string `json:"value"`
+	Mime  string `json:"mime"`
+	Name  string `json:"name"`
+}
+
 type ChatConversationRequest struct {
-	ConversationID string   `json:"-"`
-	Files          []any    `json:"files,omitempty"`
-	ID             string   `json:"id"`
-	Inputs         string   `json:"inputs"`
-	IsContinue     bool     `json:"is_continue"`
-	IsRetry        bool     `json:"is_retry"`
-	WebSearch      bool     `json:"web_search"`
-	Tools          []string `json:"tools"`
+	ConversationID string                  `json:"-"`
+	Files          []*ChatConversationFile `json:"files,omitempty"`
+	ID             string                  `json:"id"`
+	Inputs         string                  `json:"inputs"`
+	IsContinue     bool                    `json:"is_continue"`
+	IsRetry        bool                    `json:"is_retry"`
+	WebSearch      bool                    `json:"web_search"`
+	Tools          []string                `json:"tools"`
 }
 
 // ChatConversation 对话
@@ -34,8 +43,12 @@ func ChatConversation(ctx context.Context, cookies []*http.Cookie, req *ChatConv
 		return nil, err
 	}
 	resp, err := sendDefaultHttpRequest[request.Response](ctx, http.MethodPost, func(r *request.Request) *request.Request {
-		return r.SetFormData(map[string]string{"data": string(reqBody)}).
+		r = r.SetFormData(map[string]string{"data": string(reqBody)}).
 			DisableAutoReadResponse()
+		if len(req.Files) > 0 {
+			r = r.EnableForceMultipart()
+		}
+		return r
 	}, cookies, "/chat/conversation/%s", req.ConversationID)
 	if err != nil {
 		return nil, err
@@ -53,10 +66,23 @@ func ChatConversation(ctx context.Context, cookies []*http.Cookie, req *ChatConv
 
 		defer func() {
 			close(msgChan)
+			_ = resp.Body.Close()
 		}()
 
-		for !resp.Close {
-			msgChan <- tuple.Pack2(stlerr.ErrorWith(reader.ReadString('\n')))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				err = newSendError(ctx, err)
+			}
+			// 调用方取消ctx后不再有人接收，直接退出并关闭连接
+			select {
+			case msgChan <- tuple.Pack2(line, err):
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
 		}
 	}()
 
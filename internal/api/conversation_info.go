@@ -83,7 +83,9 @@ func parseDetailConversationInfo(convID string, data []any) (*DetailConversation
 }
 
 // ConversationInfoAfterCreate 在创建会话后获取会话信息
-func ConversationInfoAfterCreate(ctx context.Context, cookies []*http.Cookie, convID string) (*DetailConversationInfo, error) {
+func ConversationInfoAfterCreate(ctx context.Context, cookies []*http.Cookie, convID string) (_ *DetailConversationInfo, err error) {
+	defer recoverParseFailure(&err)
+
 	httpResp, err := sendDefaultHttpRequest[string](ctx, http.MethodGet, func(r *request.Request) *request.Request {
 		return r.SetQueryParam("x-sveltekit-invalidated", "11")
 	}, cookies, "/chat/conversation/%s/__data.json", convID)
@@ -93,9 +95,8 @@ func ConversationInfoAfterCreate(ctx context.Context, cookies []*http.Cookie, co
 
 	rawStr := "[" + regexp.MustCompile(`}\s*\{`).ReplaceAllString(*httpResp, "},{") + "]"
 	var rawResp []map[string]any
-	err = stlerr.ErrorWrap(json.Unmarshal([]byte(rawStr), &rawResp))
-	if err != nil {
-		return nil, err
+	if err = json.Unmarshal([]byte(rawStr), &rawResp); err != nil {
+		return nil, newError(ErrorKindParseFailure, "parse http result error: %s", err.Error())
 	}
 
 	for _, rawRespItem := range rawResp {
@@ -110,11 +111,13 @@ func ConversationInfoAfterCreate(ctx context.Context, cookies []*http.Cookie, co
 			return parseDetailConversationInfo(convID, node.(map[string]any)["data"].([]any))
 		}
 	}
-	return nil, stlerr.Errorf("not found conversation, id=%s", convID)
+	return nil, newError(ErrorKindConversationNotFound, "not found conversation, id=%s", convID)
 }
 
 // ConversationInfo 获取会话信息
 func ConversationInfo(ctx context.Context, cookies []*http.Cookie, convID string) (resp *DetailConversationInfo, err error) {
+	defer recoverParseFailure(&err)
+
 	httpResp, err := sendDefaultHttpRequest[map[string]any](ctx, http.MethodGet, func(r *request.Request) *request.Request {
 		return r.SetQueryParam("x-sveltekit-invalidated", "01")
 	}, cookies, "/chat/conversation/%s/__data.json", convID)
@@ -122,8 +125,12 @@ func ConversationInfo(ctx context.Context, cookies []*http.Cookie, convID string
 		return nil, err
 	}
 	node := (*httpResp)["nodes"].([]any)[1].(map[string]any)
-	if node["type"] == "error" && strings.Contains(node["error"].(map[string]any)["message"].(string), "access to") {
-		return nil, stlerr.ErrorWrap(ErrUnauthorized)
+	if node["type"] == "error" {
+		msg := node["error"].(map[string]any)["message"].(string)
+		if strings.Contains(msg, "access to") {
+			return nil, stlerr.ErrorWrap(ErrUnauthorized)
+		}
+		return nil, newError(ErrorKindConversationNotFound, "%s, id=%s", msg, convID)
 	}
 	return parseDetailConversationInfo(convID, node["data"].([]any))
 }
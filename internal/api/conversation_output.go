@@ -0,0 +1,17 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	request "github.com/imroc/req/v3"
+)
+
+// ConversationOutput 下载会话中生成的文件
+func ConversationOutput(ctx context.Context, cookies []*http.Cookie, convID string, sha string) ([]byte, string, error) {
+	resp, err := sendDefaultHttpRequest[request.Response](ctx, http.MethodGet, nil, cookies, "/chat/conversation/%s/output/%s", convID, sha)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Bytes(), resp.GetContentType(), nil
+}
@@ -3,10 +3,14 @@ package api
 import (
 	"context"
 	"net/http"
+	"regexp"
 
 	request "github.com/imroc/req/v3"
 )
 
+// modelNotFoundRegexp HuggingChat模型不存在或不可用时的错误信息
+var modelNotFoundRegexp = regexp.MustCompile(`(?i)(invalid|unknown|unsupported) model|model\b.*\b(not (found|available|supported)|does not exist|unavailable)`)
+
 type CreateConversationRequest struct {
 	Model     string `json:"model"`
 	PrePrompt string `json:"preprompt"`
@@ -18,7 +22,12 @@ type CreateConversationResponse struct {
 
 // CreateConversation 创建会话
 func CreateConversation(ctx context.Context, cookies []*http.Cookie, req *CreateConversationRequest) (*CreateConversationResponse, error) {
-	return sendDefaultHttpRequest[CreateConversationResponse](ctx, http.MethodPost, func(r *request.Request) *request.Request {
+	resp, err := sendDefaultHttpRequest[CreateConversationResponse](ctx, http.MethodPost, func(r *request.Request) *request.Request {
 		return r.SetBodyJsonMarshal(req)
 	}, cookies, "/chat/conversation")
+	// 模型不存在时返回400，其他400错误（如系统提示词过长）保留原信息
+	if apiErr, ok := AsError(err); ok && apiErr.StatusCode == http.StatusBadRequest && modelNotFoundRegexp.MatchString(apiErr.Message) {
+		return nil, newError(ErrorKindModelNotFound, "model `%s` not found", req.Model)
+	}
+	return resp, err
 }
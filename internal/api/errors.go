@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	request "github.com/imroc/req/v3"
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+)
+
+type ErrorKind string
+
+const (
+	ErrorKindUnauthorized         ErrorKind = "unauthorized"
+	ErrorKindRateLimited          ErrorKind = "rate_limited"
+	ErrorKindQuotaExceeded        ErrorKind = "quota_exceeded"
+	ErrorKindInvalidRequest       ErrorKind = "invalid_request" // HuggingChat拒绝了请求参数
+	ErrorKindModelNotFound        ErrorKind = "model_not_found"
+	ErrorKindConversationNotFound ErrorKind = "conversation_not_found"
+	ErrorKindUpstreamUnavailable  ErrorKind = "upstream_unavailable"
+	ErrorKindUpstreamError        ErrorKind = "upstream_error" // HuggingChat返回了其他无法归类的错误
+	ErrorKindParseFailure         ErrorKind = "parse_failure"
+)
+
+// Error 请求HuggingChat时发生的错误，可以用errors.Is与同类型的哨兵错误比较
+type Error struct {
+	Kind       ErrorKind
+	Message    string
+	StatusCode int           // HuggingChat返回的状态码，没有时为0
+	RetryAfter time.Duration // 建议的重试等待时间，没有时为0
+}
+
+var (
+	ErrUnauthorized         = &Error{Kind: ErrorKindUnauthorized, Message: "unauthorized"}
+	ErrRateLimited          = &Error{Kind: ErrorKindRateLimited, Message: "rate limited"}
+	ErrQuotaExceeded        = &Error{Kind: ErrorKindQuotaExceeded, Message: "quota exceeded"}
+	ErrInvalidRequest       = &Error{Kind: ErrorKindInvalidRequest, Message: "invalid request"}
+	ErrModelNotFound        = &Error{Kind: ErrorKindModelNotFound, Message: "model not found"}
+	ErrConversationNotFound = &Error{Kind: ErrorKindConversationNotFound, Message: "conversation not found"}
+	ErrUpstreamUnavailable  = &Error{Kind: ErrorKindUpstreamUnavailable, Message: "upstream unavailable"}
+	ErrUpstreamError        = &Error{Kind: ErrorKindUpstreamError, Message: "upstream error"}
+	ErrParseFailure         = &Error{Kind: ErrorKindParseFailure, Message: "parse failure"}
+)
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("http error: code=%d, message=%s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind == e.Kind
+}
+
+// IsLimited 是否为限流或额度用尽，这类错误需要账号冷却到恢复时间
+func (e *Error) IsLimited() bool {
+	return e.Kind == ErrorKindRateLimited || e.Kind == ErrorKindQuotaExceeded
+}
+
+// AsError 取出错误链中的*Error
+func AsError(err error) (*Error, bool) {
+	var apiErr *Error
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+func newError(kind ErrorKind, format string, a ...any) error {
+	return stlerr.ErrorWrap(&Error{Kind: kind, Message: fmt.Sprintf(format, a...)})
+}
+
+// newSendError 转换发送请求时的错误，调用方取消时保留原错误
+func newSendError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	return stlerr.ErrorWrap(&Error{Kind: ErrorKindUpstreamUnavailable, Message: err.Error()})
+}
+
+// newStatusError 按HuggingChat返回的状态码和错误信息转换错误
+func newStatusError(resp *request.Response) error {
+	msg := responseMessage(resp)
+	err := &Error{
+		Kind:       ErrorKindUpstreamError,
+		Message:    stlval.Ternary(msg != "", msg, resp.GetStatus()),
+		StatusCode: resp.GetStatusCode(),
+	}
+	// 有状态码时以状态码为准，错误信息只用于区分限流和额度用尽以及估计恢复时间
+	if code := resp.GetStatusCode(); code == http.StatusTooManyRequests || code == http.StatusPaymentRequired {
+		err.Kind = ErrorKindRateLimited
+		if code == http.StatusPaymentRequired || quotaMessageRegexp.MatchString(msg) {
+			err.Kind = ErrorKindQuotaExceeded
+		}
+		if err.RetryAfter = responseRetryAfter(resp); err.RetryAfter == 0 {
+			err.RetryAfter = parseResetTime(msg)
+		}
+		if err.RetryAfter == 0 {
+			err.RetryAfter = defaultCooldown(err.Kind)
+		}
+		return stlerr.ErrorWrap(err)
+	}
+
+	switch code := resp.GetStatusCode(); {
+	case code == http.StatusBadRequest || code == http.StatusRequestEntityTooLarge || code == http.StatusUnprocessableEntity:
+		err.Kind = ErrorKindInvalidRequest
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		err.Kind = ErrorKindUnauthorized
+	case code == http.StatusNotFound:
+		// 会返回404的接口请求的都是会话或会话中的资源
+		err.Kind = ErrorKindConversationNotFound
+	case code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout:
+		err.Kind = ErrorKindUpstreamUnavailable
+		err.RetryAfter = responseRetryAfter(resp)
+	}
+	return stlerr.ErrorWrap(err)
+}
+
+// responseMessage 读取错误响应中的信息，响应体通常为{"message": "..."}
+func responseMessage(resp *request.Response) string {
+	body, err := resp.ToString()
+	if err != nil {
+		return ""
+	}
+	var obj struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal([]byte(body), &obj) == nil && obj.Message != "" {
+		return obj.Message
+	}
+	// 非JSON的响应体可能是整个错误页面
+	body = strings.TrimSpace(body)
+	if strings.HasPrefix(body, "<") || len(body) > 512 {
+		return ""
+	}
+	return body
+}
+
+// responseRetryAfter 从响应头获取重试等待时间
+func responseRetryAfter(resp *request.Response) time.Duration {
+	if retryAfter := parseRetryAfter(resp.GetHeader("Retry-After")); retryAfter > 0 {
+		return retryAfter
+	}
+	for _, key := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		value := resp.GetHeader(key)
+		// 可能是剩余秒数或Unix时间戳
+		if secs, err := strconv.ParseInt(value, 10, 64); err == nil && secs > 0 {
+			if at := time.Unix(secs, 0); at.After(time.Now()) {
+				return time.Until(at)
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return 0
+}
+
+var (
+	// quotaMessageRegexp HuggingChat及HuggingFace推理服务额度用尽时的信息
+	quotaMessageRegexp = regexp.MustCompile(`(?i)exceeded your monthly included credits|(reached|exceeded) (the |your )?(free )?monthly (usage )?limit|(exceeded|exhausted|reached) (the |your )?(\w+ )?quota|insufficient (credits|quota)|subscribe to pro to get`)
+	// limitMessageRegexp HuggingChat限流时的信息
+	limitMessageRegexp = regexp.MustCompile(`(?i)rate.?limit(ed)?\b|too many (requests|messages)|sending (too many messages|messages too (fast|quickly))|(message|request) limit (reached|exceeded)|reached (the|your) (message|request|rate) limit`)
+	resetMessageRegexp = regexp.MustCompile(`(?i)(\d+)\s*(seconds?|secs?|s\b|minutes?|mins?|m\b|hours?|hrs?|h\b|days?|d\b)`)
+)
+
+// ParseLimitMessage 识别消息流中HuggingChat的限流或额度用尽信息，并尽量从中估计恢复时间
+func ParseLimitMessage(msg string) (*Error, bool) {
+	var kind ErrorKind
+	if quotaMessageRegexp.MatchString(msg) {
+		kind = ErrorKindQuotaExceeded
+	} else if limitMessageRegexp.MatchString(msg) {
+		kind = ErrorKindRateLimited
+	} else {
+		return nil, false
+	}
+
+	err := &Error{Kind: kind, Message: msg, RetryAfter: parseResetTime(msg)}
+	if err.RetryAfter == 0 {
+		err.RetryAfter = defaultCooldown(kind)
+	}
+	return err, true
+}
+
+// parseResetTime 从限流信息中估计恢复时间，没有时返回0
+func parseResetTime(msg string) time.Duration {
+	match := resetMessageRegexp.FindStringSubmatch(msg)
+	if match == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	var unit time.Duration
+	switch strings.ToLower(match[2])[0] {
+	case 's':
+		unit = time.Second
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	}
+	return time.Duration(n) * unit
+}
+
+func defaultCooldown(kind ErrorKind) time.Duration {
+	if kind == ErrorKindQuotaExceeded {
+		return config.QuotaCooldown
+	}
+	return config.RateLimitCooldown
+}
+
+// parseRetryAfter 解析秒数或HTTP日期格式的Retry-After
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	} else if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil && time.Until(at) > 0 {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// recoverParseFailure 将解析HuggingChat数据时的panic转换为解析错误
+func recoverParseFailure(err *error) {
+	if errObj := recover(); errObj != nil {
+		*err = newError(ErrorKindParseFailure, "parse http result error: %v", errObj)
+	}
+}
@@ -9,7 +9,6 @@ import (
 
 	request "github.com/imroc/req/v3"
 	stlslices "github.com/kkkunny/stl/container/slices"
-	stlerr "github.com/kkkunny/stl/error"
 	stlval "github.com/kkkunny/stl/value"
 )
 
@@ -19,6 +18,9 @@ type ModelInfo struct {
 	Desc         string
 	MaxNewTokens int64
 	Active       bool
+	Multimodal   bool
+	// AcceptedMimeTypes 可以随消息上传的文件类型，支持image/*形式的通配
+	AcceptedMimeTypes []string
 }
 
 type SimpleConversationInfo struct {
@@ -29,7 +31,9 @@ type SimpleConversationInfo struct {
 }
 
 // ListModelsAndConversations 列出模型和会话
-func ListModelsAndConversations(ctx context.Context, cookies []*http.Cookie) ([]*ModelInfo, []*SimpleConversationInfo, error) {
+func ListModelsAndConversations(ctx context.Context, cookies []*http.Cookie) (_ []*ModelInfo, _ []*SimpleConversationInfo, err error) {
+	defer recoverParseFailure(&err)
+
 	httpResp, err := sendDefaultHttpRequest[string](ctx, http.MethodGet, func(r *request.Request) *request.Request {
 		return r.SetQueryParam("x-sveltekit-invalidated", "10")
 	}, cookies, "/chat/models/__data.json")
@@ -39,9 +43,8 @@ func ListModelsAndConversations(ctx context.Context, cookies []*http.Cookie) ([]
 
 	rawStr := "[" + regexp.MustCompile(`}\s*{`).ReplaceAllString(*httpResp, "},{") + "]"
 	var rawResp []map[string]any
-	err = stlerr.ErrorWrap(json.Unmarshal([]byte(rawStr), &rawResp))
-	if err != nil {
-		return nil, nil, err
+	if err = json.Unmarshal([]byte(rawStr), &rawResp); err != nil {
+		return nil, nil, newError(ErrorKindParseFailure, "parse http result error: %s", err.Error())
 	}
 	nodes := stlval.IgnoreWith(stlslices.FindFirst(rawResp, func(_ int, kvs map[string]any) bool {
 		return kvs["type"] == "data"
@@ -68,6 +71,8 @@ func ListModelsAndConversations(ctx context.Context, cookies []*http.Cookie) ([]
 			unlisted := data[unlistedIndex].(bool)
 			var desc string
 			var maxNewTokens int64
+			var multimodal bool
+			var acceptedMimeTypes []string
 			if !unlisted {
 				desc = data[descriptionIndex].(string)
 				parameters := data[parametersIndex].(map[string]any)
@@ -75,6 +80,17 @@ func ListModelsAndConversations(ctx context.Context, cookies []*http.Cookie) ([]
 					maxNewTokensIndex := int64(parameters["max_new_tokens"].(float64))
 					maxNewTokens = int64(data[maxNewTokensIndex].(float64))
 				}
+				if multimodalIndex, existMultimodalIndex := modelMetaInfo["multimodal"]; existMultimodalIndex {
+					multimodal, _ = data[int64(multimodalIndex.(float64))].(bool)
+				}
+				if mimeTypesIndex, existMimeTypesIndex := modelMetaInfo["multimodalAcceptedMimetypes"]; existMimeTypesIndex {
+					mimeTypeIndexList, _ := data[int64(mimeTypesIndex.(float64))].([]any)
+					for _, mimeTypeIndex := range mimeTypeIndexList {
+						if mimeType, ok := data[int64(mimeTypeIndex.(float64))].(string); ok {
+							acceptedMimeTypes = append(acceptedMimeTypes, mimeType)
+						}
+					}
+				}
 			}
 
 			return &ModelInfo{
@@ -83,6 +99,9 @@ func ListModelsAndConversations(ctx context.Context, cookies []*http.Cookie) ([]
 				Desc:         desc,
 				MaxNewTokens: maxNewTokens,
 				Active:       !unlisted,
+				Multimodal:   multimodal,
+
+				AcceptedMimeTypes: acceptedMimeTypes,
 			}
 		})
 	}
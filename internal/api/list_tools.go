@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	request "github.com/imroc/req/v3"
+)
+
+type ToolInfo struct {
+	ID          string
+	Name        string
+	DisplayName string
+	Description string
+	Type        string // config为内置工具，community为社区工具
+}
+
+// ListTools 列出可用的工具
+func ListTools(ctx context.Context, cookies []*http.Cookie) (_ []*ToolInfo, err error) {
+	defer recoverParseFailure(&err)
+
+	httpResp, err := sendDefaultHttpRequest[string](ctx, http.MethodGet, func(r *request.Request) *request.Request {
+		return r.SetQueryParam("x-sveltekit-invalidated", "11")
+	}, cookies, "/chat/tools/__data.json")
+	if err != nil {
+		return nil, err
+	}
+
+	rawStr := "[" + regexp.MustCompile(`}\s*{`).ReplaceAllString(*httpResp, "},{") + "]"
+	var rawResp []map[string]any
+	if err = json.Unmarshal([]byte(rawStr), &rawResp); err != nil {
+		return nil, newError(ErrorKindParseFailure, "parse http result error: %s", err.Error())
+	}
+
+	var tools []*ToolInfo
+	exists := make(map[string]struct{})
+	for _, kvs := range rawResp {
+		nodes, _ := kvs["nodes"].([]any)
+		for _, node := range nodes {
+			nodeMap, _ := node.(map[string]any)
+			if nodeMap["type"] != "data" {
+				continue
+			}
+			data, _ := nodeMap["data"].([]any)
+			if len(data) == 0 {
+				continue
+			}
+			indexMap, _ := data[0].(map[string]any)
+			toolsIndex, ok := indexMap["tools"].(float64)
+			if !ok {
+				continue
+			}
+			toolList, _ := resolveDevalue(data, int64(toolsIndex), 0).([]any)
+			for _, toolObj := range toolList {
+				tool, _ := toolObj.(map[string]any)
+				id, _ := tool["_id"].(string)
+				if id == "" {
+					continue
+				} else if _, ok := exists[id]; ok {
+					continue
+				}
+				exists[id] = struct{}{}
+				info := &ToolInfo{ID: id, Type: "community"}
+				info.Name, _ = tool["name"].(string)
+				info.DisplayName, _ = tool["displayName"].(string)
+				info.Description, _ = tool["description"].(string)
+				if toolType, _ := tool["type"].(string); toolType != "" {
+					info.Type = toolType
+				}
+				tools = append(tools, info)
+			}
+		}
+	}
+	return tools, nil
+}
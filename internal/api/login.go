@@ -2,7 +2,6 @@ package api
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -14,8 +13,6 @@ import (
 	"github.com/kkkunny/HuggingChatAPI/config"
 )
 
-var ErrUnauthorized = errors.New("unauthorized")
-
 // Login 登录
 func Login(ctx context.Context, username string, password string) ([]*http.Cookie, error) {
 	cli := globalHttpClient.Clone()
@@ -73,7 +70,8 @@ func login(ctx context.Context, cli *req.Client, req *loginRequest) (*loginRespo
 	if err != nil {
 		return nil, err
 	} else if resp.GetStatusCode() != http.StatusFound {
-		return nil, stlerr.Errorf("http error: code=%d, status=%s", resp.GetStatusCode(), resp.GetStatus())
+		// 用户名或密码错误时会返回登录页面
+		return nil, stlerr.ErrorWrap(&Error{Kind: ErrorKindUnauthorized, Message: "login failed", StatusCode: resp.GetStatusCode()})
 	}
 	return &loginResponse{Cookies: resp.Cookies()}, nil
 }
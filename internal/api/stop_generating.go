@@ -0,0 +1,14 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	request "github.com/imroc/req/v3"
+)
+
+// StopGenerating 停止会话中正在进行的生成
+func StopGenerating(ctx context.Context, cookies []*http.Cookie, convID string) error {
+	_, err := sendDefaultHttpRequest[request.Response](ctx, http.MethodPost, nil, cookies, "/chat/conversation/%s/stop-generating", convID)
+	return err
+}
@@ -32,13 +32,11 @@ func sendDefaultHttpRequest[Result any](ctx context.Context, method string, reqH
 	if customRet {
 		req = req.SetSuccessResult(stlval.Default[Result]())
 	}
-	resp, err := stlerr.ErrorWith(req.Send(method, uri))
+	resp, err := req.Send(method, uri)
 	if err != nil {
-		return nil, err
-	} else if resp.GetStatusCode() == http.StatusUnauthorized {
-		return nil, stlerr.ErrorWrap(ErrUnauthorized)
+		return nil, newSendError(ctx, err)
 	} else if resp.GetStatusCode() != http.StatusOK {
-		return nil, stlerr.Errorf("http error: code=%d, status=%s", resp.GetStatusCode(), resp.GetStatus())
+		return nil, newStatusError(resp)
 	}
 
 	switch any(stlval.Default[Result]()).(type) {
@@ -48,12 +46,45 @@ func sendDefaultHttpRequest[Result any](ctx context.Context, method string, reqH
 		return stlval.Ptr(any(resp.String()).(Result)), nil
 	default:
 		if resp.ResultState() != request.SuccessState {
-			return nil, stlerr.Errorf("parse http result error: code=%d, status=%s", resp.GetStatusCode(), resp.GetStatus())
+			return nil, newError(ErrorKindParseFailure, "parse http result error: code=%d, status=%s", resp.GetStatusCode(), resp.GetStatus())
 		}
 		res, ok := resp.SuccessResult().(*Result)
 		if !ok {
-			return nil, stlerr.Errorf("parse http result error: code=%d, status=%s", resp.GetStatusCode(), resp.GetStatus())
+			return nil, newError(ErrorKindParseFailure, "parse http result error: code=%d, status=%s", resp.GetStatusCode(), resp.GetStatus())
 		}
 		return res, nil
 	}
 }
+
+// resolveDevalue 还原SvelteKit devalue格式数据中index指向的值
+func resolveDevalue(data []any, index int64, depth int) any {
+	if index < 0 || index >= int64(len(data)) || depth > 32 {
+		return nil
+	}
+	switch value := data[index].(type) {
+	case map[string]any:
+		obj := make(map[string]any, len(value))
+		for key, idx := range value {
+			if idxNum, ok := idx.(float64); ok {
+				obj[key] = resolveDevalue(data, int64(idxNum), depth+1)
+			}
+		}
+		return obj
+	case []any:
+		// ["Date", "..."]之类的特殊类型
+		if len(value) > 0 {
+			if _, ok := value[0].(string); ok {
+				return value[len(value)-1]
+			}
+		}
+		list := make([]any, 0, len(value))
+		for _, idx := range value {
+			if idxNum, ok := idx.(float64); ok {
+				list = append(list, resolveDevalue(data, int64(idxNum), depth+1))
+			}
+		}
+		return list
+	default:
+		return value
+	}
+}
@@ -0,0 +1,257 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	stlerr "github.com/kkkunny/stl/error"
+)
+
+const bpeCacheSize = 100000
+
+type tokenizerPattern struct {
+	String string `json:"String"`
+	Regex  string `json:"Regex"`
+}
+
+type tokenizerNormalizer struct {
+	Type        string                 `json:"type"`
+	Normalizers []*tokenizerNormalizer `json:"normalizers"`
+	Pattern     tokenizerPattern       `json:"pattern"`
+	Content     string                 `json:"content"`
+}
+
+type tokenizerPreTokenizer struct {
+	Type             string                   `json:"type"`
+	Pretokenizers    []*tokenizerPreTokenizer `json:"pretokenizers"`
+	Pattern          tokenizerPattern         `json:"pattern"`
+	IndividualDigits bool                     `json:"individual_digits"`
+}
+
+// tokenizerFile HuggingFace tokenizers库的tokenizer.json文件
+type tokenizerFile struct {
+	Normalizer   *tokenizerNormalizer   `json:"normalizer"`
+	PreTokenizer *tokenizerPreTokenizer `json:"pre_tokenizer"`
+	Model        struct {
+		Type         string          `json:"type"`
+		Vocab        map[string]int  `json:"vocab"`
+		Merges       json.RawMessage `json:"merges"`
+		ByteFallback bool            `json:"byte_fallback"`
+		IgnoreMerges bool            `json:"ignore_merges"`
+	} `json:"model"`
+}
+
+// bpeTokenizer BPE分词器，支持字节级BPE（Llama 3、Qwen、Command-R等）和SentencePiece BPE（Llama 2、Mistral等）
+type bpeTokenizer struct {
+	vocab        map[string]int
+	ranks        map[string]int
+	byteFallback bool
+	ignoreMerges bool
+
+	byteLevel bool
+	metaspace bool
+	gpt2      bool
+	maxDigits int
+
+	cacheLock sync.Mutex
+	cache     map[string]int
+}
+
+// Load 加载tokenizer.json格式的分词器文件
+func Load(path string) (Tokenizer, error) {
+	data, err := stlerr.ErrorWith(os.ReadFile(path))
+	if err != nil {
+		return nil, err
+	}
+	var file tokenizerFile
+	if err = stlerr.ErrorWrap(json.Unmarshal(data, &file)); err != nil {
+		return nil, err
+	} else if file.Model.Type != "BPE" {
+		return nil, stlerr.Errorf("unsupported tokenizer model `%s`", file.Model.Type)
+	}
+
+	var merges [][]string
+	var mergeStrs []string
+	if err = json.Unmarshal(file.Model.Merges, &mergeStrs); err == nil {
+		for _, merge := range mergeStrs {
+			merges = append(merges, strings.SplitN(merge, " ", 2))
+		}
+	} else if err = stlerr.ErrorWrap(json.Unmarshal(file.Model.Merges, &merges)); err != nil {
+		return nil, err
+	}
+
+	tok := &bpeTokenizer{
+		vocab:        file.Model.Vocab,
+		ranks:        make(map[string]int, len(merges)),
+		byteFallback: file.Model.ByteFallback,
+		ignoreMerges: file.Model.IgnoreMerges,
+		gpt2:         true,
+		cache:        make(map[string]int),
+	}
+	for i, merge := range merges {
+		if len(merge) != 2 {
+			return nil, stlerr.Errorf("invalid merge at %d", i)
+		}
+		tok.ranks[merge[0]+"\x00"+merge[1]] = i
+	}
+	tok.parsePreTokenizer(file.PreTokenizer)
+	tok.parseNormalizer(file.Normalizer)
+	return tok, nil
+}
+
+func (tok *bpeTokenizer) parsePreTokenizer(pre *tokenizerPreTokenizer) {
+	if pre == nil {
+		return
+	}
+	switch pre.Type {
+	case "Sequence":
+		for _, sub := range pre.Pretokenizers {
+			tok.parsePreTokenizer(sub)
+		}
+	case "ByteLevel":
+		tok.byteLevel = true
+	case "Metaspace":
+		tok.metaspace = true
+	case "Digits":
+		if pre.IndividualDigits {
+			tok.maxDigits = 1
+		}
+	case "Split":
+		// Llama 3、Qwen等模型的正则，只区分连续数字的长度
+		regex := pre.Pattern.Regex
+		if !strings.Contains(regex, `\p{L}`) {
+			return
+		}
+		tok.gpt2 = false
+		switch {
+		case strings.Contains(regex, `\p{N}{1,3}`):
+			tok.maxDigits = 3
+		case strings.Contains(regex, `\p{N}+`):
+			tok.maxDigits = 0
+		default:
+			tok.maxDigits = 1
+		}
+	}
+}
+
+func (tok *bpeTokenizer) parseNormalizer(norm *tokenizerNormalizer) {
+	if norm == nil {
+		return
+	}
+	switch norm.Type {
+	case "Sequence":
+		for _, sub := range norm.Normalizers {
+			tok.parseNormalizer(sub)
+		}
+	case "Replace":
+		if norm.Pattern.String == " " && norm.Content == "▁" {
+			tok.metaspace = true
+		}
+	}
+}
+
+func (tok *bpeTokenizer) Split(text string) []string {
+	if tok.metaspace {
+		return splitLongPieces(splitMetaspace(text))
+	}
+	return splitLongPieces(splitWords(text, tok.gpt2, tok.maxDigits))
+}
+
+func (tok *bpeTokenizer) CountPiece(piece string) int {
+	if piece == "" {
+		return 0
+	}
+	tok.cacheLock.Lock()
+	count, ok := tok.cache[piece]
+	tok.cacheLock.Unlock()
+	if ok {
+		return count
+	}
+
+	count = tok.encode(tok.normalize(piece))
+
+	tok.cacheLock.Lock()
+	if len(tok.cache) >= bpeCacheSize {
+		tok.cache = make(map[string]int)
+	}
+	tok.cache[piece] = count
+	tok.cacheLock.Unlock()
+	return count
+}
+
+// normalize 转换为词表中的字符形式
+func (tok *bpeTokenizer) normalize(piece string) string {
+	switch {
+	case tok.byteLevel:
+		var builder strings.Builder
+		for _, b := range []byte(piece) {
+			builder.WriteRune(byteLevelRunes[b])
+		}
+		return builder.String()
+	case tok.metaspace:
+		if !strings.HasPrefix(piece, " ") {
+			piece = " " + piece
+		}
+		return strings.ReplaceAll(piece, " ", "▁")
+	default:
+		return piece
+	}
+}
+
+// encode 对一个片段做BPE合并，返回token数
+func (tok *bpeTokenizer) encode(word string) int {
+	if _, ok := tok.vocab[word]; ok && (tok.ignoreMerges || len([]rune(word)) == 1) {
+		return 1
+	}
+
+	symbols := strings.Split(word, "")
+	for len(symbols) > 1 {
+		bestRank, bestIdx := -1, -1
+		for i := 0; i < len(symbols)-1; i++ {
+			if rank, ok := tok.ranks[symbols[i]+"\x00"+symbols[i+1]]; ok && (bestRank < 0 || rank < bestRank) {
+				bestRank, bestIdx = rank, i
+			}
+		}
+		if bestIdx < 0 {
+			break
+		}
+		first, second := symbols[bestIdx], symbols[bestIdx+1]
+		merged := make([]string, 0, len(symbols)-1)
+		for i := 0; i < len(symbols); i++ {
+			if i < len(symbols)-1 && symbols[i] == first && symbols[i+1] == second {
+				merged = append(merged, first+second)
+				i++
+			} else {
+				merged = append(merged, symbols[i])
+			}
+		}
+		symbols = merged
+	}
+
+	var count int
+	for _, symbol := range symbols {
+		if _, ok := tok.vocab[symbol]; ok || !tok.byteFallback {
+			count++
+		} else {
+			count += len(symbol)
+		}
+	}
+	return count
+}
+
+// byteLevelRunes GPT-2字节级BPE中字节到可见字符的映射
+var byteLevelRunes = func() [256]rune {
+	var runes [256]rune
+	n := 0
+	for b := 0; b < 256; b++ {
+		if b >= '!' && b <= '~' || b >= 0xA1 && b <= 0xAC || b >= 0xAE && b <= 0xFF {
+			runes[b] = rune(b)
+		} else {
+			runes[b] = rune(256 + n)
+			n++
+		}
+	}
+	return runes
+}()
@@ -0,0 +1,49 @@
+package tokenizer
+
+import "unicode"
+
+// Estimator 没有分词器文件时使用的估算分词器：字母和数字每4个算1个token，
+// 中日韩字符、符号每个算1个token，空白字符不计
+type Estimator struct{}
+
+func (Estimator) Split(text string) []string {
+	return splitLongPieces(splitWords(text, true, 0))
+}
+
+func (Estimator) CountPiece(piece string) int {
+	var count, wordLen int
+	for _, r := range piece {
+		switch {
+		case isSpace(r):
+			wordLen = 0
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			wordLen = 0
+			count++
+		case isLetter(r) || isNumber(r) || unicode.IsMark(r):
+			if wordLen%4 == 0 {
+				count++
+			}
+			wordLen++
+		default:
+			wordLen = 0
+			count++
+		}
+	}
+	return count
+}
+
+func isLetter(r rune) bool {
+	return unicode.IsLetter(r)
+}
+
+func isNumber(r rune) bool {
+	return unicode.IsNumber(r)
+}
+
+func isSpace(r rune) bool {
+	return unicode.IsSpace(r)
+}
+
+func isPunct(r rune) bool {
+	return !isLetter(r) && !isNumber(r) && !isSpace(r)
+}
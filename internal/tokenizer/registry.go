@@ -0,0 +1,112 @@
+package tokenizer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+)
+
+// modelFamilies 按模型ID中的关键字确定模型系列，靠前的优先匹配
+var modelFamilies = []struct {
+	Family   string
+	Keywords []string
+}{
+	{Family: "llama", Keywords: []string{"llama"}},
+	{Family: "qwen", Keywords: []string{"qwen", "qwq"}},
+	{Family: "mistral", Keywords: []string{"mistral", "mixtral", "codestral"}},
+	{Family: "command-r", Keywords: []string{"command-r", "c4ai", "cohere", "aya"}},
+	{Family: "gemma", Keywords: []string{"gemma"}},
+	{Family: "phi", Keywords: []string{"phi-"}},
+	{Family: "deepseek", Keywords: []string{"deepseek"}},
+	{Family: "nemotron", Keywords: []string{"nemotron"}},
+	{Family: "hermes", Keywords: []string{"hermes"}},
+	{Family: "smollm", Keywords: []string{"smollm"}},
+}
+
+// maxEstimatedModels 最多记录的使用估算分词器的模型数，模型名来自请求，需要限制数量
+const maxEstimatedModels = 256
+
+var (
+	filesOnce sync.Once
+	files     map[string]bool // TokenizerDir下的分词器文件名（不含扩展名），启动后首次查找时读取
+
+	cacheLock sync.Mutex
+	cache     = make(map[string]Tokenizer) // 按分词器文件名缓存，数量不超过files
+	estimated = make(map[string]bool)      // 已提示过使用估算分词器的模型
+)
+
+// listFiles 列出TokenizerDir下的分词器文件名
+func listFiles() map[string]bool {
+	filesOnce.Do(func() {
+		files = make(map[string]bool)
+		entries, err := os.ReadDir(config.TokenizerDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			_ = config.Logger.Warnf("list tokenizer dir `%s` failed: %s", config.TokenizerDir, err.Error())
+		}
+		for _, entry := range entries {
+			if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !entry.IsDir() {
+				files[name] = true
+			}
+		}
+	})
+	return files
+}
+
+// Family 模型所属的系列，未知时返回空字符串
+func Family(model string) string {
+	model = strings.ToLower(model)
+	for _, family := range modelFamilies {
+		for _, keyword := range family.Keywords {
+			if strings.Contains(model, keyword) {
+				return family.Family
+			}
+		}
+	}
+	return ""
+}
+
+// ForModel 返回模型对应的分词器，依次查找TokenizerDir下的{模型ID}.json（/替换为--）和{模型系列}.json，
+// 都不存在时返回估算分词器。TokenizerDir只在首次查找时读取，之后添加的分词器文件需要重启才会生效
+func ForModel(model string) Tokenizer {
+	names := []string{strings.ReplaceAll(model, "/", "--")}
+	if family := Family(model); family != "" {
+		names = append(names, family)
+	}
+	for _, name := range names {
+		if !listFiles()[name] {
+			continue
+		}
+		if tok := loadCached(name); tok != nil {
+			return tok
+		}
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if !estimated[model] && len(estimated) < maxEstimatedModels {
+		estimated[model] = true
+		_ = config.Logger.Infof("no tokenizer file for model `%s` in `%s`, estimate tokens by characters (restart after adding one)", model, config.TokenizerDir)
+	}
+	return Estimator{}
+}
+
+// loadCached 加载并缓存TokenizerDir下名为name的分词器，加载失败时返回nil，失败的结果同样会被缓存
+func loadCached(name string) Tokenizer {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	if tok, ok := cache[name]; ok {
+		return tok
+	}
+	path := filepath.Join(config.TokenizerDir, name+".json")
+	tok, err := Load(path)
+	if err != nil {
+		_ = config.Logger.Warnf("load tokenizer `%s` failed: %s", path, err.Error())
+	}
+	cache[name] = tok
+	return tok
+}
@@ -0,0 +1,214 @@
+package tokenizer
+
+import "strings"
+
+// maxPieceLength 片段的最大字符数，更长的片段（如没有空格的base64数据）切分后分别计算，
+// 避免BPE合并的耗时随片段长度平方增长
+const maxPieceLength = 64
+
+// Tokenizer 分词器，文本先预分词为独立编码的片段，再分别计算token数
+type Tokenizer interface {
+	// Split 预分词，返回的片段拼接后与原文相同
+	Split(text string) []string
+	// CountPiece 计算一个片段的token数
+	CountPiece(piece string) int
+}
+
+// Count 计算文本的token数
+func Count(tok Tokenizer, text string) int {
+	var count int
+	for _, piece := range tok.Split(text) {
+		count += tok.CountPiece(piece)
+	}
+	return count
+}
+
+// Counter 增量计算流式文本的token数
+type Counter struct {
+	tok       Tokenizer
+	committed int
+	tail      string // 最后一个片段可能随后续文本变化，暂不计入
+}
+
+func NewCounter(tok Tokenizer) *Counter {
+	return &Counter{tok: tok}
+}
+
+// Feed 输入文本，limit大于0时只接受总数不超过limit个token的前缀，返回接受的文本以及是否被截断
+func (c *Counter) Feed(text string, limit int) (string, bool) {
+	buf := c.tail + text
+	pieces := c.tok.Split(buf)
+	counts := make([]int, len(pieces))
+	total := c.committed
+	for i, piece := range pieces {
+		counts[i] = c.tok.CountPiece(piece)
+		total += counts[i]
+	}
+	if limit <= 0 || total <= limit {
+		if len(pieces) > 0 {
+			c.committed = total - counts[len(pieces)-1]
+			c.tail = pieces[len(pieces)-1]
+		}
+		return text, false
+	}
+
+	// 找到超出限制的片段，保留其中不超过限制的最长前缀
+	accepted, count := 0, c.committed
+	for i, piece := range pieces {
+		if count+counts[i] <= limit {
+			accepted += len(piece)
+			count += counts[i]
+			continue
+		}
+		var prefix string
+		for j := range piece {
+			if j > 0 && count+c.tok.CountPiece(piece[:j]) > limit {
+				break
+			}
+			prefix = piece[:j]
+		}
+		accepted += len(prefix)
+		count += c.tok.CountPiece(prefix)
+		break
+	}
+	c.committed, c.tail = count, ""
+	if accepted < len(buf)-len(text) {
+		return "", true
+	}
+	return text[:accepted-(len(buf)-len(text))], true
+}
+
+// Count 已接受文本的token数
+func (c *Counter) Count() int {
+	if c.tail == "" {
+		return c.committed
+	}
+	return c.committed + c.tok.CountPiece(c.tail)
+}
+
+// splitLongPieces 将超过maxPieceLength个字符的片段切分为多个片段
+func splitLongPieces(pieces []string) []string {
+	var result []string
+	for i, piece := range pieces {
+		if len(piece) <= maxPieceLength {
+			if result != nil {
+				result = append(result, piece)
+			}
+			continue
+		}
+		if result == nil {
+			result = append(make([]string, 0, len(pieces)), pieces[:i]...)
+		}
+		runes := []rune(piece)
+		for len(runes) > maxPieceLength {
+			result = append(result, string(runes[:maxPieceLength]))
+			runes = runes[maxPieceLength:]
+		}
+		result = append(result, string(runes))
+	}
+	if result == nil {
+		return pieces
+	}
+	return result
+}
+
+// splitWords 按GPT系列分词器的预分词规则切分文本，
+// gpt2为true时使用GPT-2的规则，否则使用Llama 3、Qwen等模型的规则，maxDigits限制连续数字的长度
+func splitWords(text string, gpt2 bool, maxDigits int) []string {
+	runes := []rune(text)
+	var pieces []string
+	for i := 0; i < len(runes); {
+		n := matchWord(runes[i:], gpt2, maxDigits)
+		pieces = append(pieces, string(runes[i:i+n]))
+		i += n
+	}
+	return pieces
+}
+
+var contractions = []string{"s", "t", "re", "ve", "m", "ll", "d"}
+
+func matchWord(r []rune, gpt2 bool, maxDigits int) int {
+	// 英文缩写
+	if r[0] == '\'' {
+		for _, suffix := range contractions {
+			if len(r) > len(suffix) && (string(r[1:1+len(suffix)]) == suffix || !gpt2 && strings.EqualFold(string(r[1:1+len(suffix)]), suffix)) {
+				return 1 + len(suffix)
+			}
+		}
+	}
+
+	// 字母，GPT-2允许前置一个空格，其他规则允许前置一个非换行的符号
+	start := 0
+	if len(r) > 1 && isLetter(r[1]) && (gpt2 && r[0] == ' ' || !gpt2 && isPunct(r[0]) || !gpt2 && r[0] != '\r' && r[0] != '\n' && isSpace(r[0])) {
+		start = 1
+	}
+	if isLetter(r[start]) {
+		n := start
+		for n < len(r) && isLetter(r[n]) {
+			n++
+		}
+		return n
+	}
+
+	// 数字
+	start = 0
+	if gpt2 && len(r) > 1 && r[0] == ' ' && isNumber(r[1]) {
+		start = 1
+	}
+	if isNumber(r[start]) {
+		n := start
+		for n < len(r) && isNumber(r[n]) && (maxDigits <= 0 || n-start < maxDigits) {
+			n++
+		}
+		return n
+	}
+
+	// 符号，前面可以有一个空格，其他规则会带上后面的换行
+	start = 0
+	if len(r) > 1 && r[0] == ' ' && isPunct(r[1]) {
+		start = 1
+	}
+	if isPunct(r[start]) {
+		n := start
+		for n < len(r) && isPunct(r[n]) {
+			n++
+		}
+		for !gpt2 && n < len(r) && (r[n] == '\r' || r[n] == '\n') {
+			n++
+		}
+		return n
+	}
+
+	// 空白，最后一个空白字符留给后面的单词
+	n := 0
+	for n < len(r) && isSpace(r[n]) {
+		n++
+	}
+	if !gpt2 {
+		for i := n - 1; i >= 0; i-- {
+			if r[i] == '\r' || r[i] == '\n' {
+				return i + 1
+			}
+		}
+	}
+	if n == len(r) || n == 1 {
+		return n
+	}
+	return n - 1
+}
+
+// splitMetaspace 按空格切分文本，用于SentencePiece系列的分词器
+func splitMetaspace(text string) []string {
+	var pieces []string
+	start := 0
+	for i := 1; i < len(text); i++ {
+		if text[i] == ' ' && text[i-1] != ' ' {
+			pieces = append(pieces, text[start:i])
+			start = i
+		}
+	}
+	if start < len(text) {
+		pieces = append(pieces, text[start:])
+	}
+	return pieces
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	stlerr "github.com/kkkunny/stl/error"
+	"github.com/labstack/echo/v4"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/internal/api"
+)
+
+type accountStrategy string
+
+const (
+	accountStrategyRoundRobin    accountStrategy = "round_robin"     // 依次轮流使用
+	accountStrategyLeastInFlight accountStrategy = "least_in_flight" // 使用进行中请求最少的账号
+	accountStrategySticky        accountStrategy = "sticky"          // 同一用户固定使用同一账号，以便接续会话
+)
+
+const (
+	poolAttemptKey      = "account_pool_attempt"
+	accountHealthWeight = 0.2 // 最近一次请求结果在健康度中的权重
+	accountHealthy      = 0.5 // 健康度不低于该值的账号优先使用
+	// accountHealthRecovery 健康度随时间向1恢复的时间常数，避免不健康的账号因为一直没有请求而无法恢复
+	accountHealthRecovery = 5 * time.Minute
+)
+
+// poolFailoverRoutes 失败后可以换一个账号重试的接口，只有这些接口需要缓存请求体
+var poolFailoverRoutes = map[string]bool{
+	"/v1/chat/completions":   true,
+	"/v1/completions":        true,
+	"/v1/images/generations": true,
+	"/v1/messages":           true,
+	"/v1/responses":          true,
+	"/api/chat":              true,
+	"/api/generate":          true,
+	"/v1beta/models/*":       true,
+}
+
+var globalAccountPool = newAccountPool(config.Accounts, accountStrategy(config.AccountStrategy))
+
+// poolAccount 账号池中的账号
+type poolAccount struct {
+	credential string
+	provider   hugchat.TokenProvider
+
+	inFlight      int
+	health        float64 // 按指数加权平均的请求成功率，更新于healthAt
+	healthAt      time.Time
+	disabledUntil time.Time // 凭证失效后的冷却截止时间
+}
+
+// currentHealth 当前的健康度，距离上次更新越久越接近1
+func (account *poolAccount) currentHealth(now time.Time) float64 {
+	elapsed := now.Sub(account.healthAt)
+	if elapsed <= 0 {
+		return account.health
+	}
+	return 1 - (1-account.health)*math.Exp(-float64(elapsed)/float64(accountHealthRecovery))
+}
+
+// updateHealth 按请求结果更新健康度
+func (account *poolAccount) updateHealth(success bool) {
+	now := time.Now()
+	account.health = account.currentHealth(now) * (1 - accountHealthWeight)
+	if success {
+		account.health += accountHealthWeight
+	}
+	account.healthAt = now
+}
+
+// unavailableUntil 账号因凭证失效或限流而不可用的截止时间
+func (account *poolAccount) unavailableUntil() time.Time {
+	until := account.disabledUntil
+	if cooldownUntil, ok := hugchat.CooldownUntil(account.provider.Account()); ok && cooldownUntil.After(until) {
+		until = cooldownUntil
+	}
+	return until
+}
+
+// accountPool 服务端配置的HuggingChat账号池
+type accountPool struct {
+	strategy accountStrategy
+
+	lock     sync.Mutex
+	accounts []*poolAccount
+	next     int
+}
+
+func newAccountPool(credentials []string, strategy accountStrategy) *accountPool {
+	switch strategy {
+	case accountStrategyRoundRobin, accountStrategyLeastInFlight, accountStrategySticky:
+	default:
+		_ = config.Logger.Warnf("unknown account strategy `%s`, use %s", strategy, accountStrategyRoundRobin)
+		strategy = accountStrategyRoundRobin
+	}
+	pool := &accountPool{strategy: strategy}
+	for _, credential := range credentials {
+		provider, err := parseAuthorization(credential)
+		if err != nil {
+			_ = config.Logger.Warnf("invalid account in pool: %s", err.Error())
+			continue
+		}
+		pool.accounts = append(pool.accounts, &poolAccount{credential: credential, provider: provider, health: 1})
+	}
+	if len(pool.accounts) > 0 {
+		_ = config.Logger.Infof("account pool: %d accounts, strategy=%s", len(pool.accounts), strategy)
+	}
+	return pool
+}
+
+func (pool *accountPool) Enabled() bool {
+	return len(pool.accounts) > 0
+}
+
+// Acquire 选择一个可用的账号，userKey用于sticky策略，exclude中的账号不会被选择
+func (pool *accountPool) Acquire(userKey string, exclude map[*poolAccount]bool) (*poolAccount, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	now := time.Now()
+	var candidates, healthy []*poolAccount
+	var recoverAt time.Time
+	for i := range pool.accounts {
+		// 从轮询位置开始遍历，round_robin和同等条件下的其他策略都从这里轮流
+		account := pool.accounts[(pool.next+i)%len(pool.accounts)]
+		if exclude[account] {
+			continue
+		}
+		if until := account.unavailableUntil(); until.After(now) {
+			if recoverAt.IsZero() || until.Before(recoverAt) {
+				recoverAt = until
+			}
+			continue
+		}
+		candidates = append(candidates, account)
+		if account.currentHealth(now) >= accountHealthy {
+			healthy = append(healthy, account)
+		}
+	}
+	if len(candidates) == 0 && recoverAt.IsZero() {
+		return nil, stlerr.ErrorWrap(&api.Error{Kind: api.ErrorKindUpstreamUnavailable, Message: "no available account in pool"})
+	} else if len(candidates) == 0 {
+		return nil, stlerr.ErrorWrap(&api.Error{
+			Kind:       api.ErrorKindRateLimited,
+			Message:    "all accounts in pool are cooling down",
+			RetryAfter: time.Until(recoverAt),
+		})
+	}
+	if len(healthy) > 0 {
+		candidates = healthy
+	}
+
+	account := candidates[0]
+	switch pool.strategy {
+	case accountStrategyLeastInFlight:
+		for _, candidate := range candidates[1:] {
+			if candidate.inFlight < account.inFlight || (candidate.inFlight == account.inFlight && candidate.currentHealth(now) > account.currentHealth(now)) {
+				account = candidate
+			}
+		}
+	case accountStrategySticky:
+		// 最高随机权重哈希，账号不可用时同一用户会稳定地落到另一个账号
+		var maxWeight uint64
+		for _, candidate := range candidates {
+			hash := fnv.New64a()
+			_, _ = hash.Write([]byte(userKey + "\x00" + candidate.credential))
+			if weight := hash.Sum64(); weight >= maxWeight {
+				account, maxWeight = candidate, weight
+			}
+		}
+	}
+	for i, a := range pool.accounts {
+		if a == account {
+			pool.next = i + 1
+			break
+		}
+	}
+	account.inFlight++
+	return account, nil
+}
+
+// AcquireByHash 选择凭证摘要为credentialHash的账号，用于接续只存在于该账号中的会话
+func (pool *accountPool) AcquireByHash(credentialHash string) (*poolAccount, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, account := range pool.accounts {
+		if hashString(account.credential) != credentialHash {
+			continue
+		}
+		if until := account.unavailableUntil(); until.After(time.Now()) {
+			return nil, stlerr.ErrorWrap(&api.Error{
+				Kind:       api.ErrorKindRateLimited,
+				Message:    "account of the conversation is cooling down",
+				RetryAfter: time.Until(until),
+			})
+		}
+		account.inFlight++
+		return account, nil
+	}
+	return nil, stlerr.ErrorWrap(&api.Error{Kind: api.ErrorKindConversationNotFound, Message: "account of the conversation is no longer in pool"})
+}
+
+// CredentialByHash 查找凭证摘要为credentialHash的账号的凭证
+func (pool *accountPool) CredentialByHash(credentialHash string) (string, bool) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, account := range pool.accounts {
+		if hashString(account.credential) == credentialHash {
+			return account.credential, true
+		}
+	}
+	return "", false
+}
+
+// Cancel 归还没有使用的账号，不影响健康度
+func (pool *accountPool) Cancel(account *poolAccount) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	account.inFlight--
+}
+
+// Release 请求结束后归还账号，并按请求结果更新健康度
+func (pool *accountPool) Release(account *poolAccount, err error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	account.inFlight--
+	if err == nil {
+		account.updateHealth(true)
+		return
+	} else if !isAccountError(err) {
+		return
+	}
+	account.updateHealth(false)
+	if isUnauthorizedError(err) {
+		account.disabledUntil = time.Now().Add(config.AccountUnauthorizedCooldown)
+		_ = config.Logger.Warnf("account `%s` is unauthorized, disabled until %s", account.provider.Account(), account.disabledUntil.Format(time.RFC3339))
+	}
+}
+
+func isUnauthorizedError(err error) bool {
+	return errors.Is(err, api.ErrUnauthorized) || errors.Is(err, hugchat.RefreshTokenError)
+}
+
+// isAccountError 是否为与账号相关、换一个账号可能成功的错误
+func isAccountError(err error) bool {
+	if isUnauthorizedError(err) {
+		return true
+	}
+	apiErr, ok := api.AsError(err)
+	if !ok {
+		return false
+	}
+	switch apiErr.Kind {
+	case api.ErrorKindRateLimited, api.ErrorKindQuotaExceeded, api.ErrorKindUpstreamUnavailable, api.ErrorKindUpstreamError:
+		return true
+	default:
+		return false
+	}
+}
+
+// poolAttempt 一个请求使用账号池的状态
+type poolAttempt struct {
+	userKey string
+	tried   map[*poolAccount]bool
+	current *poolAccount
+}
+
+// midAccountPool 使用账号池的请求失败且还未输出任何内容时，换一个账号重新处理请求
+func midAccountPool(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(reqCtx echo.Context) error {
+		if !globalAccountPool.Enabled() {
+			return next(reqCtx)
+		}
+
+		attempt := &poolAttempt{
+			userKey: reqCtx.Request().Header.Get("X-User-ID"),
+			tried:   make(map[*poolAccount]bool),
+		}
+		if attempt.userKey == "" {
+			attempt.userKey = reqCtx.Request().Header.Get("Authorization") + "\x00" + reqCtx.RealIP()
+		}
+		reqCtx.Set(poolAttemptKey, attempt)
+		defer func() {
+			// 处理请求时panic
+			if attempt.current != nil {
+				globalAccountPool.Release(attempt.current, stlerr.Errorf("request panicked"))
+			}
+		}()
+
+		// 只缓存可以重试的接口的请求体，超过上限时不重试
+		var body []byte
+		retryable := reqCtx.Request().Method == http.MethodGet
+		if !retryable && poolFailoverRoutes[reqCtx.Path()] {
+			var err error
+			body, err = stlerr.ErrorWith(io.ReadAll(io.LimitReader(reqCtx.Request().Body, config.AccountRetryBodyLimit+1)))
+			if err != nil {
+				return err
+			}
+			retryable = int64(len(body)) <= config.AccountRetryBodyLimit
+			if !retryable {
+				reqCtx.Request().Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), reqCtx.Request().Body))
+			}
+		}
+
+		var lastErr error
+		for {
+			if retryable && body != nil {
+				reqCtx.Request().Body = io.NopCloser(bytes.NewReader(body))
+			}
+			err := next(reqCtx)
+
+			account := attempt.current
+			if account == nil && lastErr != nil {
+				// 没有可以换用的账号，返回上一个账号的错误
+				return lastErr
+			} else if account == nil {
+				return err
+			}
+			attempt.current = nil
+			globalAccountPool.Release(account, err)
+			if err == nil || !retryable || reqCtx.Response().Committed || !isAccountError(err) || len(attempt.tried) >= config.AccountMaxAttempts {
+				return err
+			}
+			lastErr = err
+			_ = config.Logger.Warnf("request with account `%s` failed, try another one: %s", account.provider.Account(), err.Error())
+		}
+	}
+}
+
+// requestAuth 请求的凭证
+type requestAuth struct {
+	Token      string                // 请求携带的凭证，用作文件等资源的所有者
+	User       string                // 使用账号池时区分请求方的用户标识
+	Credential string                // 实际访问HuggingChat的凭证，使用账号池时为选中账号的凭证，用作会话的所有者
+	Provider   hugchat.TokenProvider // Credential对应的TokenProvider
+}
+
+// usesAccountPool 请求携带的凭证是否使用账号池
+func usesAccountPool(token string) bool {
+	return globalAccountPool.Enabled() && token == config.AccountsAPIKey
+}
+
+// checkAuthorization 校验不需要访问HuggingChat的请求携带的凭证
+func checkAuthorization(token string) error {
+	if usesAccountPool(token) {
+		return nil
+	}
+	_, err := parseAuthorization(token)
+	return err
+}
+
+// newRequestAuth 解析请求携带的凭证，凭证为ACCOUNTS_API_KEY且配置了账号池时从账号池中选择账号
+func newRequestAuth(reqCtx echo.Context, token string) (*requestAuth, error) {
+	attempt, ok := reqCtx.Get(poolAttemptKey).(*poolAttempt)
+	if !ok || !usesAccountPool(token) {
+		provider, err := parseAuthorization(token)
+		if err != nil {
+			_ = config.Logger.Error(err)
+			return nil, echo.ErrUnauthorized
+		}
+		return &requestAuth{Token: token, Credential: token, Provider: provider}, nil
+	}
+
+	if attempt.current == nil {
+		account, err := globalAccountPool.Acquire(attempt.userKey, attempt.tried)
+		if err != nil {
+			return nil, err
+		}
+		attempt.tried[account] = true
+		attempt.current = account
+	}
+	return &requestAuth{Token: token, User: attempt.userKey, Credential: attempt.current.credential, Provider: attempt.current.provider}, nil
+}
+
+// SessionOwner 会话映射的所有者，使用账号池时同一账号被多个请求方共用，需要同时区分请求方和账号
+func (auth *requestAuth) SessionOwner() string {
+	if auth.User == "" {
+		return auth.Credential
+	}
+	return strings.Join([]string{auth.Token, auth.User, auth.Credential}, "\x00")
+}
+
+// Pin 将请求使用的账号切换为凭证摘要为credentialHash的账号，未使用账号池时不切换
+func (auth *requestAuth) Pin(reqCtx echo.Context, credentialHash string) (*requestAuth, error) {
+	attempt, ok := reqCtx.Get(poolAttemptKey).(*poolAttempt)
+	if !ok || attempt.current == nil || credentialHash == "" || hashString(auth.Credential) == credentialHash {
+		return auth, nil
+	}
+	account, err := globalAccountPool.AcquireByHash(credentialHash)
+	if err != nil {
+		return nil, err
+	}
+	globalAccountPool.Cancel(attempt.current)
+	attempt.tried[account] = true
+	attempt.current = account
+	return &requestAuth{Token: auth.Token, User: auth.User, Credential: account.credential, Provider: account.provider}, nil
+}
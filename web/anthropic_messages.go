@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+// anthropicContent Anthropic消息内容，可以是字符串或内容块列表
+type anthropicContent []anthropicRequestBlock
+
+func (c *anthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if json.Unmarshal(data, &text) == nil {
+		*c = anthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []anthropicRequestBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// Text 拼接内容中的文本块
+func (c anthropicContent) Text() string {
+	texts := stlslices.Map(stlslices.Filter(c, func(_ int, block anthropicRequestBlock) bool {
+		return block.Type == "text"
+	}), func(_ int, block anthropicRequestBlock) string {
+		return block.Text
+	})
+	return strings.Join(texts, "\n")
+}
+
+type anthropicRequestBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content anthropicContent `json:"content"`
+}
+
+type anthropicMessagesRequest struct {
+	Model         string             `json:"model"`
+	System        anthropicContent   `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	TopK          *int               `json:"top_k,omitempty"`
+}
+
+// ChatMessages 转换为OpenAI格式的消息历史
+func (req *anthropicMessagesRequest) ChatMessages() []openai.ChatCompletionMessage {
+	msgs := make([]openai.ChatCompletionMessage, 0, len(req.Messages)+1)
+	if system := req.System.Text(); system != "" {
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: system})
+	}
+	for _, msg := range req.Messages {
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: msg.Role, Content: msg.Content.Text()})
+	}
+	return msgs
+}
+
+type anthropicTextBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicThinkingBlock struct {
+	Type      string `json:"type"`
+	Thinking  string `json:"thinking"`
+	Signature string `json:"signature"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicMessagesResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []any          `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        anthropicUsage `json:"usage"`
+}
+
+func anthropicStopReason(reader *chatReader) (*string, *string) {
+	switch reader.FinishReason {
+	case chatFinishReasonLength:
+		return stlval.Ptr("max_tokens"), nil
+	case chatFinishReasonStopSequence:
+		return stlval.Ptr("stop_sequence"), stlval.Ptr(reader.StopSequence)
+	default:
+		return stlval.Ptr("end_turn"), nil
+	}
+}
+
+func anthropicMessages(reqCtx echo.Context) error {
+	authToken := reqCtx.Request().Header.Get("x-api-key")
+	if authToken == "" {
+		authToken = strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer ")
+	}
+	auth, err := newRequestAuth(reqCtx, authToken)
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	var req anthropicMessagesRequest
+	if err = stlerr.ErrorWrap(reqCtx.Bind(&req)); err != nil {
+		_ = config.Logger.Error(err)
+		return echo.ErrBadRequest
+	}
+	if len(req.Messages) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "messages must not be empty")
+	} else if req.MaxTokens <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "max_tokens must be greater than 0")
+	}
+
+	turn, err := resolveChatTurn(reqCtx.Request().Context(), cli, auth, req.Model, req.ChatMessages(), nil, "")
+	if err != nil {
+		return err
+	}
+	_, msgChan, err := turn.Chat(reqCtx.Request().Context(), cli, func(turn *chatTurn) string {
+		return buildChatPrompt(turn.Messages, "", nil)
+	})
+	if err != nil {
+		return err
+	}
+	reader := newChatReader(msgChan, chatReaderOptions{
+		StopSequences: req.StopSequences,
+		MaxTokens:     req.MaxTokens,
+		ReasoningMode: modelReasoningMode(turn.Model),
+		Tokenizer:     tokenizer.ForModel(turn.Model),
+		Abort:         turn.Abort,
+	})
+
+	if req.Stream {
+		return anthropicMessagesWithStream(reqCtx, cli, turn, reader)
+	}
+	return anthropicMessagesNoStream(reqCtx, cli, turn, reader)
+}
+
+func anthropicMessagesNoStream(reqCtx echo.Context, cli *hugchat.Client, turn *chatTurn, reader *chatReader) error {
+	if _, err := reader.ReadAll(reqCtx.Request().Context()); err != nil {
+		return err
+	}
+
+	content := make([]any, 0, 2)
+	if reader.Reasoning.Len() > 0 {
+		content = append(content, &anthropicThinkingBlock{Type: "thinking", Thinking: reader.Reasoning.String()})
+	}
+	content = append(content, &anthropicTextBlock{Type: "text", Text: reader.Text.String()})
+	turn.Save(cli, reader, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reader.Text.String()})
+
+	stopReason, stopSequence := anthropicStopReason(reader)
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, &anthropicMessagesResponse{
+		ID:           newRandomID("msg_"),
+		Type:         "message",
+		Role:         openai.ChatMessageRoleAssistant,
+		Model:        turn.Model,
+		Content:      content,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
+		Usage:        anthropicUsage{InputTokens: turn.PromptTokens(), OutputTokens: reader.Tokens},
+	}, "  "))
+}
+
+func anthropicMessagesWithStream(reqCtx echo.Context, cli *hugchat.Client, turn *chatTurn, reader *chatReader) error {
+	writer := reqCtx.Response()
+	setSSEHeaders(writer)
+
+	err := writeSSEEvent(writer, "message_start", map[string]any{
+		"type": "message_start",
+		"message": &anthropicMessagesResponse{
+			ID:      newRandomID("msg_"),
+			Type:    "message",
+			Role:    openai.ChatMessageRoleAssistant,
+			Model:   turn.Model,
+			Content: []any{},
+			Usage:   anthropicUsage{InputTokens: turn.PromptTokens()},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	blockIndex, blockType := -1, ""
+	switchBlock := func(newType string) error {
+		if blockType == newType {
+			return nil
+		}
+		if blockType != "" {
+			err := writeSSEEvent(writer, "content_block_stop", map[string]any{"type": "content_block_stop", "index": blockIndex})
+			if err != nil {
+				return err
+			}
+		}
+		blockIndex, blockType = blockIndex+1, newType
+		var block any
+		switch newType {
+		case "thinking":
+			block = &anthropicThinkingBlock{Type: newType}
+		case "text":
+			block = &anthropicTextBlock{Type: newType}
+		default:
+			return nil
+		}
+		return writeSSEEvent(writer, "content_block_start", map[string]any{"type": "content_block_start", "index": blockIndex, "content_block": block})
+	}
+
+	for {
+		event, err := reader.Next(reqCtx.Request().Context())
+		if err != nil {
+			status, body := newOpenAIError(err)
+			_ = writeSSEEvent(writer, "error", newAnthropicErrorResponse(status, body.Message))
+			return err
+		} else if event == nil {
+			break
+		}
+
+		switch event.Type {
+		case chatEventReasoning:
+			if err = switchBlock("thinking"); err != nil {
+				return err
+			}
+			err = writeSSEEvent(writer, "content_block_delta", map[string]any{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": map[string]any{"type": "thinking_delta", "thinking": event.Text},
+			})
+		case chatEventText:
+			if err = switchBlock("text"); err != nil {
+				return err
+			}
+			err = writeSSEEvent(writer, "content_block_delta", map[string]any{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": map[string]any{"type": "text_delta", "text": event.Text},
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if blockType == "" {
+		if err = switchBlock("text"); err != nil {
+			return err
+		}
+	}
+	if err = switchBlock(""); err != nil {
+		return err
+	}
+	turn.Save(cli, reader, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reader.Text.String()})
+
+	stopReason, stopSequence := anthropicStopReason(reader)
+	err = writeSSEEvent(writer, "message_delta", map[string]any{
+		"type":  "message_delta",
+		"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": stopSequence},
+		"usage": map[string]any{"output_tokens": reader.Tokens},
+	})
+	if err != nil {
+		return err
+	}
+	return writeSSEEvent(writer, "message_stop", map[string]any{"type": "message_stop"})
+}
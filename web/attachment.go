@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+)
+
+const maxImageSize = 10 << 20
+
+// imageHttpClient 下载图片用的客户端，只允许连接公网地址
+var imageHttpClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(_ string, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+					return stlerr.Errorf("address `%s` is not allowed", address)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return stlerr.Errorf("too many redirects")
+		}
+		return checkImageURL(req.URL)
+	},
+}
+
+// prepareMessageFiles 处理消息中的图片和文档，模型支持的作为HuggingChat文件随消息上传，
+// 不支持上传的文档在本地提取文本后内联到消息中
+func prepareMessageFiles(ctx context.Context, cli *hugchat.Client, owner string, model string, msgs []openai.ChatCompletionMessage, fileParts chatFileParts) ([]openai.ChatCompletionMessage, []*dto.ConversationFile, error) {
+	hasAttachment := stlslices.Any(msgs, func(_ int, msg openai.ChatCompletionMessage) bool {
+		return stlslices.Any(msg.MultiContent, func(_ int, part openai.ChatMessagePart) bool {
+			return part.Type == openai.ChatMessagePartTypeImageURL || part.Type == chatMessagePartTypeFile
+		})
+	})
+	if !hasAttachment {
+		return msgs, nil, nil
+	}
+
+	models, err := cli.ListModels(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	modelInfo, _ := stlslices.FindFirst(models, func(_ int, info *dto.ModelInfo) bool {
+		return info.ID == model
+	})
+
+	var files []*dto.ConversationFile
+	newMsgs := make([]openai.ChatCompletionMessage, len(msgs))
+	for i, msg := range msgs {
+		newMsgs[i] = msg
+		if len(msg.MultiContent) == 0 {
+			continue
+		}
+		parts := make([]openai.ChatMessagePart, 0, len(msg.MultiContent))
+		for j, part := range msg.MultiContent {
+			switch part.Type {
+			case openai.ChatMessagePartTypeImageURL:
+				if part.ImageURL == nil {
+					continue
+				} else if modelInfo == nil || !modelInfo.Multimodal {
+					return nil, nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("model `%s` does not support image input", model))
+				}
+				file, err := loadImageURL(ctx, part.ImageURL.URL)
+				if err != nil {
+					return nil, nil, err
+				}
+				file.Name = fmt.Sprintf("image-%d.%s", len(files), strings.TrimPrefix(file.MIME, "image/"))
+				files = append(files, file)
+			case chatMessagePartTypeFile:
+				file, err := loadFilePart(owner, fileParts.Get(&msg.MultiContent[j]))
+				if err != nil {
+					return nil, nil, err
+				}
+				if modelInfo != nil && modelInfo.Accepts(file.MIME) {
+					files = append(files, file)
+					continue
+				}
+				text, err := extractDocumentText(file)
+				if err != nil {
+					return nil, nil, err
+				}
+				parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: text})
+			default:
+				parts = append(parts, part)
+			}
+		}
+		newMsgs[i].MultiContent = parts
+	}
+	return newMsgs, files, nil
+}
+
+// loadImageURL 读取data URL或下载图片
+func loadImageURL(ctx context.Context, rawURL string) (*dto.ConversationFile, error) {
+	if strings.HasPrefix(rawURL, "data:") {
+		meta, data, ok := strings.Cut(strings.TrimPrefix(rawURL, "data:"), ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "image data url must be base64 encoded")
+		}
+		content, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "image data url is not valid base64")
+		}
+		return newImageFile(strings.TrimSuffix(meta, ";base64"), content)
+	}
+
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid image url")
+	} else if err = checkImageURL(uri); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	req, err := stlerr.ErrorWith(http.NewRequestWithContext(ctx, http.MethodGet, uri.String(), nil))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := imageHttpClient.Do(req)
+	if err != nil {
+		_ = config.Logger.Error(err)
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("download image `%s` failed", rawURL))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("download image `%s` failed: %s", rawURL, resp.Status))
+	}
+	content, err := stlerr.ErrorWith(io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1)))
+	if err != nil {
+		return nil, err
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return newImageFile(mimeType, content)
+}
+
+func newImageFile(mimeType string, content []byte) (*dto.ConversationFile, error) {
+	if len(content) > maxImageSize {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("image must not exceed %d bytes", maxImageSize))
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(content)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "unsupported image type")
+	}
+	return &dto.ConversationFile{MIME: mimeType, Data: content}, nil
+}
+
+// checkImageURL 检查图片地址是否允许下载
+func checkImageURL(uri *url.URL) error {
+	if uri.Scheme != "http" && uri.Scheme != "https" {
+		return stlerr.Errorf("image url scheme must be http or https")
+	}
+	if len(config.ImageURLAllowedHosts) > 0 && !slices.Contains(config.ImageURLAllowedHosts, strings.ToLower(uri.Hostname())) {
+		return stlerr.Errorf("image url host `%s` is not allowed", uri.Hostname())
+	}
+	return nil
+}
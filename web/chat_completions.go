@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	stlslices "github.com/kkkunny/stl/container/slices"
@@ -17,102 +19,445 @@ import (
 	"github.com/kkkunny/HuggingChatAPI/config"
 	"github.com/kkkunny/HuggingChatAPI/hugchat"
 	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
 )
 
+// chatCompletionRequest 在openai.ChatCompletionRequest的基础上覆盖或扩展部分字段
+type chatCompletionRequest struct {
+	openai.ChatCompletionRequest
+	ResponseFormat *responseFormat  `json:"response_format,omitempty"`
+	FileOutput     fileOutputFormat `json:"file_output,omitempty"` // 生成文件的返回方式，默认为签名地址
+	FileEvents     bool             `json:"file_events,omitempty"` // 流式输出时是否额外发送file事件
+	// WebSearch和WebSearchOptions任意一个存在时启用HuggingChat的网络搜索
+	WebSearch        bool            `json:"web_search,omitempty"`
+	WebSearchOptions json.RawMessage `json:"web_search_options,omitempty"`
+	HFTools          []string        `json:"hf_tools,omitempty"`    // 启用的HuggingChat工具ID，见/v1/tools
+	ToolEvents       bool            `json:"tool_events,omitempty"` // 流式输出时是否额外发送tool事件
+	ReasoningMode    reasoningMode   `json:"reasoning_mode,omitempty"`
+	Stop             stringList      `json:"stop,omitempty"` // 允许传入单个字符串
+
+	files chatFileParts
+}
+
+// WebSearchEnabled 是否启用网络搜索
+func (req *chatCompletionRequest) WebSearchEnabled() bool {
+	return req.WebSearch || (len(req.WebSearchOptions) > 0 && string(req.WebSearchOptions) != "null")
+}
+
+// chatCompletionMessage 在openai.ChatCompletionMessage的基础上扩展annotations字段
+type chatCompletionMessage struct {
+	openai.ChatCompletionMessage
+	Annotations []*messageAnnotation
+}
+
+func (msg chatCompletionMessage) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(msg.ChatCompletionMessage)
+	if err != nil || len(msg.Annotations) == 0 {
+		return data, err
+	}
+	var obj map[string]json.RawMessage
+	if err = json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	if obj["annotations"], err = json.Marshal(msg.Annotations); err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+type chatCompletionChoice struct {
+	Index        int                   `json:"index"`
+	Message      chatCompletionMessage `json:"message"`
+	FinishReason openai.FinishReason   `json:"finish_reason"`
+}
+
+type chatCompletionResponse struct {
+	ID      string                  `json:"id"`
+	Object  string                  `json:"object"`
+	Created int64                   `json:"created"`
+	Model   string                  `json:"model"`
+	Choices []*chatCompletionChoice `json:"choices"`
+	Usage   openai.Usage            `json:"usage"`
+}
+
+// chatToolEvent tool事件的数据
+type chatToolEvent struct {
+	Index      int                            `json:"index"`
+	UUID       string                         `json:"uuid,omitempty"`
+	Subtype    dto.StreamMessageSubType       `json:"subtype"`
+	Name       string                         `json:"name,omitempty"`
+	Parameters dto.StreamMessageToolParameter `json:"parameters,omitempty"`
+	Eta        *float64                       `json:"eta,omitempty"`
+	Status     dto.StreamMessageStatus        `json:"status,omitempty"`
+	Outputs    []map[string]any               `json:"outputs,omitempty"`
+	Message    string                         `json:"message,omitempty"`
+}
+
+func newChatToolEvent(msg *dto.StreamMessage) *chatToolEvent {
+	event := &chatToolEvent{
+		UUID:    stlval.DerefPtrOr(msg.UUID),
+		Subtype: stlval.DerefPtrOr(msg.SubType),
+		Eta:     msg.Eta,
+		Status:  stlval.DerefPtrOr(msg.Status),
+		Message: stlval.DerefPtrOr(msg.Message),
+	}
+	call := msg.Call
+	if msg.Result != nil {
+		event.Status, event.Outputs = msg.Result.Status, msg.Result.Outputs
+		if msg.Result.Message != "" {
+			event.Message = msg.Result.Message
+		}
+		if call == nil {
+			call = msg.Result.Call
+		}
+	}
+	if call != nil {
+		event.Name, event.Parameters = call.Name, call.Parameters
+	}
+	return event
+}
+
+// chatFileEvent file事件的数据
+type chatFileEvent struct {
+	Index          int    `json:"index"`
+	ConversationID string `json:"conversation_id"`
+	Name           string `json:"name"`
+	SHA            string `json:"sha"`
+	MIME           string `json:"mime"`
+	URL            string `json:"url"`
+}
+
+func (req *chatCompletionRequest) UnmarshalJSON(data []byte) error {
+	type alias chatCompletionRequest
+	if err := json.Unmarshal(data, (*alias)(req)); err != nil {
+		return err
+	}
+
+	// go-openai会丢弃file类型内容部分的字段，需要单独解析
+	var raw struct {
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for i, msg := range raw.Messages {
+		var parts []struct {
+			Type openai.ChatMessagePartType `json:"type"`
+			File *chatFilePart              `json:"file"`
+		}
+		if i >= len(req.Messages) || json.Unmarshal(msg.Content, &parts) != nil {
+			continue
+		}
+		for j, part := range parts {
+			if part.Type == chatMessagePartTypeFile && part.File != nil && j < len(req.Messages[i].MultiContent) {
+				if req.files == nil {
+					req.files = make(chatFileParts)
+				}
+				req.files[&req.Messages[i].MultiContent[j]] = part.File
+			}
+		}
+	}
+	return nil
+}
+
+// chatCompletionsContext 对话补全处理所需的上下文
+type chatCompletionsContext struct {
+	cli          *hugchat.Client
+	req          *chatCompletionRequest
+	msgID        string
+	toolOpts     *toolCallOptions
+	promptTokens int
+	choices      []*chatCompletionsChoice
+	aborted      atomic.Bool
+}
+
+// chatCompletionsChoice 一个回复的生成状态
+type chatCompletionsChoice struct {
+	index  int
+	turn   *chatTurn
+	reader *chatReader
+}
+
+// Usage 本次请求的token用量，所有回复共用同一个提示词
+func (chatCtx *chatCompletionsContext) Usage() *openai.Usage {
+	usage := &openai.Usage{
+		PromptTokens:            chatCtx.promptTokens,
+		TotalTokens:             chatCtx.promptTokens,
+		CompletionTokensDetails: &openai.CompletionTokensDetails{},
+	}
+	for _, choice := range chatCtx.choices {
+		usage.CompletionTokens += choice.reader.Tokens
+		usage.TotalTokens += choice.reader.Tokens
+		usage.CompletionTokensDetails.ReasoningTokens += choice.reader.ReasoningTokens()
+	}
+	return usage
+}
+
+// Abort 停止所有回复的生成，被停止的回复不会被记录到会话中
+func (chatCtx *chatCompletionsContext) Abort() {
+	chatCtx.aborted.Store(true)
+	for _, choice := range chatCtx.choices {
+		choice.turn.Abort()
+	}
+}
+
+// Save 记录回复以便下一轮请求接续，请求已经被停止时不记录
+func (chatCtx *chatCompletionsContext) Save(choice *chatCompletionsChoice, reply openai.ChatCompletionMessage) {
+	if chatCtx.aborted.Load() {
+		return
+	}
+	choice.turn.Save(chatCtx.cli, choice.reader, reply)
+}
+
+// Run 并发处理所有回复，任意一个出错时调用onError并停止所有回复的生成；
+// 等待所有回复处理结束后才返回第一个错误，避免请求结束后仍有回复在处理
+func (chatCtx *chatCompletionsContext) Run(f func(choice *chatCompletionsChoice) error, onError func(err error)) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, choice := range chatCtx.choices {
+		wg.Add(1)
+		go func(choice *chatCompletionsChoice) {
+			defer wg.Done()
+			err := func() (err error) {
+				defer func() {
+					if errObj := recover(); errObj != nil {
+						_ = config.Logger.Error(errObj)
+						err = stlerr.Errorf("%v", errObj)
+					}
+				}()
+				return f(choice)
+			}()
+			if err == nil {
+				return
+			}
+			once.Do(func() {
+				firstErr = err
+				if onError != nil {
+					onError(err)
+				}
+				chatCtx.Abort()
+			})
+		}(choice)
+	}
+	wg.Wait()
+	return firstErr
+}
+
 func chatCompletions(reqCtx echo.Context) error {
-	tokenProvider, err := parseAuthorization(strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "))
+	auth, err := newRequestAuth(reqCtx, strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "))
 	if err != nil {
-		_ = config.Logger.Error(err)
-		return echo.ErrUnauthorized
+		return err
 	}
-	cli := hugchat.NewClient(tokenProvider)
+	cli := hugchat.NewClient(auth.Provider)
 
-	var req openai.ChatCompletionRequest
+	var req chatCompletionRequest
 	if err = stlerr.ErrorWrap(reqCtx.Bind(&req)); err != nil {
 		_ = config.Logger.Error(err)
 		return echo.ErrBadRequest
 	}
+	req.N = stlval.Ternary(req.N <= 0, 1, req.N)
+	if len(req.Messages) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "messages must not be empty")
+	} else if req.FileOutput != "" && req.FileOutput != fileOutputFormatURL && req.FileOutput != fileOutputFormatBase64 {
+		return echo.NewHTTPError(http.StatusBadRequest, "file_output must be url or base64")
+	} else if req.MaxTokens < 0 || req.MaxCompletionTokens < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "max_tokens must be greater than or equal to 0")
+	} else if req.N > config.MaxChoices {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("n must be less than or equal to %d", config.MaxChoices))
+	}
+	structuredOpts, err := newStructuredOutputOptions(req.ResponseFormat)
+	if err != nil {
+		return err
+	}
+	toolOpts, err := newToolCallOptions(&req.ChatCompletionRequest)
+	if err != nil {
+		return err
+	}
+	reasoningMode, err := resolveReasoningMode(req.ReasoningMode, req.Model)
+	if err != nil {
+		return err
+	}
 
-	convs, err := cli.ListConversations(reqCtx.Request().Context())
+	turn, err := resolveChatTurn(reqCtx.Request().Context(), cli, auth, req.Model, req.Messages, req.files, hashString(toolOpts.Prompt()))
 	if err != nil {
 		return err
 	}
-	convs = stlslices.Filter(convs, func(_ int, conv *dto.SimpleConversationInfo) bool {
-		return conv.Model == req.Model
-	})
-	var convInfo *dto.ConversationInfo
-	if len(convs) == 0 {
-		convInfo, err = cli.CreateConversation(reqCtx.Request().Context(), req.Model, "")
+	turn.WebSearch, turn.Tools = req.WebSearchEnabled(), req.HFTools
+	// 多个回复作为同一父消息下的兄弟分支生成
+	turns := []*chatTurn{turn}
+	for len(turns) < req.N {
+		turns = append(turns, turn.Branch())
+	}
+
+	extraPrompts := []string{toolOpts.Prompt()}
+	if structuredOpts != nil {
+		extraPrompts = append(extraPrompts, structuredOpts.Prompt())
+	}
+	chatCtx := &chatCompletionsContext{
+		cli:          cli,
+		req:          &req,
+		toolOpts:     toolOpts,
+		promptTokens: turn.PromptTokens(extraPrompts...),
+	}
+	tok := tokenizer.ForModel(turn.Model)
+	msgChans := make([]chan *dto.StreamMessage, len(turns))
+	paramsList := make([]*hugchat.ChatConversationParams, len(turns))
+	for i, turn := range turns {
+		params, msgChan, err := turn.Chat(reqCtx.Request().Context(), cli, func(turn *chatTurn) string {
+			return buildChatPrompt(turn.Messages, stlval.Ternary(turn.IncludeTools, toolOpts.Prompt(), ""), structuredOpts)
+		})
 		if err != nil {
+			chatCtx.Abort()
 			return err
 		}
-	} else {
-		convID := stlslices.Random(convs).ID
-		convInfo, err = cli.ConversationInfo(reqCtx.Request().Context(), convID)
+		if i == 0 {
+			chatCtx.msgID = params.LastMsgID
+		}
+		paramsList[i], msgChans[i] = params, msgChan
+		chatCtx.choices = append(chatCtx.choices, &chatCompletionsChoice{index: i, turn: turn})
+	}
+	if structuredOpts != nil {
+		// 每个回复各自校验并重试，互不等待
+		err = chatCtx.Run(func(choice *chatCompletionsChoice) (err error) {
+			msgChans[choice.index], err = generateStructuredOutput(reqCtx.Request().Context(), cli, choice.turn, paramsList[choice.index], structuredOpts, msgChans[choice.index])
+			return err
+		}, nil)
 		if err != nil {
 			return err
 		}
 	}
-
-	msgStrList := make([]string, len(req.Messages)+1)
-	msgStrList[0] = "Forget previous messages and focus on the current message!\n"
-	for i, msg := range req.Messages {
-		msgStrList[i+1] = fmt.Sprintf("%s: %s", msg.Role, msg.Content)
+	for _, choice := range chatCtx.choices {
+		choice.reader = newChatReader(msgChans[choice.index], chatReaderOptions{
+			StopSequences: req.Stop,
+			// max_tokens已被OpenAI弃用，优先使用max_completion_tokens
+			MaxTokens:     stlval.Ternary(req.MaxCompletionTokens > 0, req.MaxCompletionTokens, req.MaxTokens),
+			ReasoningMode: reasoningMode,
+			Tokenizer:     tok,
+			Abort:         choice.turn.Abort,
+		})
 	}
-	prompt := fmt.Sprintf("%s\nassistant: ", strings.Join(msgStrList, ""))
 
-	msgID := stlslices.Last(convInfo.Messages).ID
-	msgChan, err := cli.ChatConversation(reqCtx.Request().Context(), convInfo.ConversationID, &hugchat.ChatConversationParams{
-		LastMsgID: msgID,
-		Inputs:    prompt,
+	handler := stlval.Ternary(req.Stream, chatCompletionsWithStream, chatCompletionsNoStream)
+	return handler(reqCtx, chatCtx)
+}
+
+// messageText 提取消息中的文本内容
+func messageText(msg openai.ChatCompletionMessage) string {
+	if len(msg.MultiContent) == 0 {
+		return msg.Content
+	}
+	texts := stlslices.Map(stlslices.Filter(msg.MultiContent, func(_ int, part openai.ChatMessagePart) bool {
+		return part.Type == openai.ChatMessagePartTypeText
+	}), func(_ int, part openai.ChatMessagePart) string {
+		return part.Text
 	})
+	return strings.Join(texts, "\n")
+}
+
+// buildChatPrompt 将本轮消息拼接为输入文本，只有一条用户消息时直接发送其内容
+func buildChatPrompt(msgs []openai.ChatCompletionMessage, toolPrompt string, structuredOpts *structuredOutputOptions) string {
+	if len(msgs) == 1 && msgs[0].Role == openai.ChatMessageRoleUser && toolPrompt == "" && structuredOpts == nil {
+		return messageText(msgs[0])
+	}
+
+	msgStrList := make([]string, 0, len(msgs)+2)
+	if toolPrompt != "" {
+		msgStrList = append(msgStrList, fmt.Sprintf("%s: %s", openai.ChatMessageRoleSystem, toolPrompt))
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Role == openai.ChatMessageRoleTool:
+			msgStrList = append(msgStrList, fmt.Sprintf("%s: %s", msg.Role, formatToolResponse(msg)))
+		case len(msg.ToolCalls) > 0:
+			msgStrList = append(msgStrList, fmt.Sprintf("%s: %s", msg.Role, strings.TrimSpace(messageText(msg)+"\n"+formatToolCalls(msg.ToolCalls))))
+		default:
+			msgStrList = append(msgStrList, fmt.Sprintf("%s: %s", msg.Role, messageText(msg)))
+		}
+	}
+	if structuredOpts != nil {
+		msgStrList = append(msgStrList, fmt.Sprintf("%s: %s", openai.ChatMessageRoleSystem, structuredOpts.Prompt()))
+	}
+	return fmt.Sprintf("%s\nassistant: ", strings.Join(msgStrList, "\n"))
+}
+
+// chatFinishReason 转换为OpenAI的结束原因
+func (reason chatFinishReason) OpenAI() openai.FinishReason {
+	if reason == chatFinishReasonLength {
+		return openai.FinishReasonLength
+	}
+	return openai.FinishReasonStop
+}
+
+func chatCompletionsNoStream(reqCtx echo.Context, chatCtx *chatCompletionsContext) error {
+	resp := &chatCompletionResponse{
+		ID:      chatCtx.msgID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   chatCtx.req.Model,
+		Choices: make([]*chatCompletionChoice, len(chatCtx.choices)),
+	}
+
+	err := chatCtx.Run(func(choice *chatCompletionsChoice) (err error) {
+		resp.Choices[choice.index], err = readChatCompletionChoice(reqCtx, chatCtx, choice)
+		return err
+	}, nil)
 	if err != nil {
 		return err
 	}
 
-	handler := stlval.Ternary(req.Stream, chatCompletionsWithStream, chatCompletionsNoStream)
-	return handler(reqCtx, msgID, convInfo, msgChan)
+	resp.Model = chatCtx.choices[0].turn.Model
+	resp.Usage = *chatCtx.Usage()
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, resp, "  "))
 }
 
-func chatCompletionsNoStream(reqCtx echo.Context, msgID string, convInfo *dto.ConversationInfo, msgChan chan *dto.StreamMessage) error {
-	var tokenCount uint64
+// readChatCompletionChoice 读取一个回复的全部输出
+func readChatCompletionChoice(reqCtx echo.Context, chatCtx *chatCompletionsContext, choice *chatCompletionsChoice) (*chatCompletionChoice, error) {
+	reader := choice.reader
+	events, err := reader.ReadAll(reqCtx.Request().Context())
+	if err != nil {
+		return nil, err
+	}
+
 	var contents []openai.ChatMessagePart
-	var reasonBuffer strings.Builder
-	for msg := range msgChan {
-		switch msg.Type {
-		case dto.StreamMessageTypeError:
-			return msg.Error
-		case dto.StreamMessageTypeFinalAnswer:
-			if stlval.DerefPtrOr(msg.Text) != "" {
-				contents = append(contents, openai.ChatMessagePart{
-					Type: openai.ChatMessagePartTypeText,
-					Text: *msg.Text,
-				})
-			}
-			break
-		case dto.StreamMessageTypeStream:
-			tokenCount++
-		case dto.StreamMessageTypeFile:
-			if stlval.DerefPtrOr(msg.MIME) == "image/webp" && stlval.DerefPtrOr(msg.SHA) != "" {
-				contents = append(contents, openai.ChatMessagePart{
-					Type: openai.ChatMessagePartTypeImageURL,
-					ImageURL: &openai.ChatMessageImageURL{
-						Detail: openai.ImageURLDetailAuto,
-						URL:    fmt.Sprintf("%s/chat/conversation/%s/output/%s", config.HuggingChatDomain, convInfo.ConversationID, *msg.SHA),
-					},
-				})
-			}
-		case dto.StreamMessageTypeReasoning:
-			var reply string
-			if msg.Token != nil {
-				reply = *msg.Token
+	for _, event := range events {
+		if event.Type != chatEventFile || !strings.HasPrefix(stlval.DerefPtrOr(event.Msg.MIME), "image/") || stlval.DerefPtrOr(event.Msg.SHA) == "" {
+			continue
+		}
+		fileURL, err := fileOutputURL(reqCtx, chatCtx.cli, choice.turn.account, chatCtx.req.FileOutput, choice.turn.ConversationID, *event.Msg.SHA, *event.Msg.MIME)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				Detail: openai.ImageURLDetailAuto,
+				URL:    fileURL,
+			},
+		})
+	}
+	if reader.Text.Len() > 0 {
+		contents = append(contents, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeText,
+			Text: reader.Text.String(),
+		})
+	}
+
+	var toolCalls []openai.ToolCall
+	if chatCtx.toolOpts.Enabled() {
+		for i, content := range contents {
+			if content.Type != openai.ChatMessagePartTypeText {
+				continue
 			}
-			reply = strings.TrimRight(reply, "\u0000")
-			reasonBuffer.WriteString(reply)
-		case dto.StreamMessageTypeStatus, dto.StreamMessageTypeTool, dto.StreamMessageTypeTitle:
-		default:
-			_ = config.Logger.Warnf("unknown stream msg type `%s`", msg.Type)
+			var calls []openai.ToolCall
+			contents[i].Text, calls = parseToolCalls(content.Text)
+			toolCalls = append(toolCalls, calls...)
 		}
+		contents = stlslices.Filter(contents, func(_ int, content openai.ChatMessagePart) bool {
+			return content.Type != openai.ChatMessagePartTypeText || content.Text != ""
+		})
 	}
 
 	var reply string
@@ -120,136 +465,145 @@ func chatCompletionsNoStream(reqCtx echo.Context, msgID string, convInfo *dto.Co
 		reply = contents[0].Text
 		contents = nil
 	}
+	replyMsg := openai.ChatCompletionMessage{
+		Role:             "assistant",
+		Content:          reply,
+		MultiContent:     contents,
+		ToolCalls:        toolCalls,
+		ReasoningContent: reader.Reasoning.String(),
+	}
+	chatCtx.Save(choice, replyMsg)
 
-	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, &openai.ChatCompletionResponse{
-		ID:      msgID,
-		Object:  "chat.completion",
-		Created: time.Now().Unix(),
-		Model:   convInfo.Model,
-		Choices: []openai.ChatCompletionChoice{
-			{
-				Index: 0,
-				Message: openai.ChatCompletionMessage{
-					Role:             "assistant",
-					Content:          reply,
-					MultiContent:     contents,
-					ReasoningContent: reasonBuffer.String(),
-				},
-				FinishReason: "stop",
-			},
+	return &chatCompletionChoice{
+		Index: choice.index,
+		Message: chatCompletionMessage{
+			ChatCompletionMessage: replyMsg,
+			Annotations:           buildURLCitations(messageText(replyMsg), reader.Sources),
 		},
-		Usage: openai.Usage{
-			PromptTokens:     0,
-			CompletionTokens: int(tokenCount),
-			TotalTokens:      int(tokenCount),
-		},
-	}, "  "))
-}
-
-func chatCompletionsWithStream(reqCtx echo.Context, msgID string, convInfo *dto.ConversationInfo, msgChan chan *dto.StreamMessage) error {
-	writer := reqCtx.Response()
-	writer.Header().Set("Content-Type", "text/event-stream")
-	writer.Header().Set("Cache-Control", "no-cache")
-	writer.Header().Set("Connection", "keep-alive")
-	writer.Header().Set("Transfer-Encoding", "chunked")
-
-	for {
-		select {
-		case <-reqCtx.Request().Context().Done():
-			return stlerr.Errorf("SSE client disconnected")
-		case msg, ok := <-msgChan:
-			if !ok {
-				return nil
+		FinishReason: stlval.Ternary(len(toolCalls) > 0, openai.FinishReasonToolCalls, reader.FinishReason.OpenAI()),
+	}, nil
+}
+
+func chatCompletionsWithStream(reqCtx echo.Context, chatCtx *chatCompletionsContext) error {
+	enc := newChatCompletionStreamEncoder(reqCtx.Response(), chatCtx.msgID, chatCtx.choices[0].turn.Model)
+
+	writeFile := func(choice *chatCompletionsChoice, msg *dto.StreamMessage) error {
+		fileURL, err := fileOutputURL(reqCtx, chatCtx.cli, choice.turn.account, chatCtx.req.FileOutput, choice.turn.ConversationID, *msg.SHA, stlval.DerefPtrOr(msg.MIME))
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(stlval.DerefPtrOr(msg.MIME), "image/") {
+			err = enc.CustomDelta(choice.index, &chatCompletionStreamPartsDelta{
+				Content: []openai.ChatMessagePart{{
+					Type:     openai.ChatMessagePartTypeImageURL,
+					ImageURL: &openai.ChatMessageImageURL{URL: fileURL, Detail: openai.ImageURLDetailAuto},
+				}},
+			})
+			if err != nil {
+				return err
 			}
-			switch msg.Type {
-			case dto.StreamMessageTypeError:
-				return msg.Error
-			case dto.StreamMessageTypeFinalAnswer:
-				data, err := stlerr.ErrorWith(json.Marshal(&openai.ChatCompletionStreamResponse{
-					ID:      msgID,
-					Object:  "chat.completion",
-					Created: time.Now().Unix(),
-					Model:   convInfo.Model,
-					Choices: []openai.ChatCompletionStreamChoice{
-						{
-							Index:        0,
-							FinishReason: "stop",
-						},
-					},
-				}))
-				if err != nil {
-					return err
+		}
+		if !chatCtx.req.FileEvents {
+			return nil
+		}
+		return enc.Event("file", &chatFileEvent{
+			Index:          choice.index,
+			ConversationID: choice.turn.ConversationID,
+			Name:           stlval.DerefPtrOr(msg.Name),
+			SHA:            *msg.SHA,
+			MIME:           stlval.DerefPtrOr(msg.MIME),
+			URL:            fileURL,
+		})
+	}
+
+	streamChoice := func(choice *chatCompletionsChoice) error {
+		reader := choice.reader
+		toolParser := newToolCallStreamParser(chatCtx.toolOpts)
+		var replyBuffer strings.Builder
+		for {
+			event, err := reader.Next(reqCtx.Request().Context())
+			if err != nil {
+				return err
+			} else if event == nil {
+				break
+			}
+
+			switch event.Type {
+			case chatEventText:
+				reply := toolParser.Feed(event.Text)
+				if reply == "" {
+					continue
 				}
-				_, err = stlerr.ErrorWith(fmt.Fprint(writer, "data: "+string(data)+"\n\n"))
-				if err != nil {
+				replyBuffer.WriteString(reply)
+				if err = enc.Delta(choice.index, openai.ChatCompletionStreamChoiceDelta{Content: reply}); err != nil {
 					return err
 				}
-				writer.Flush()
-				_, err = stlerr.ErrorWith(fmt.Fprint(writer, "data: [DONE]\n\n"))
-				if err != nil {
+			case chatEventReasoning:
+				if err = enc.Delta(choice.index, openai.ChatCompletionStreamChoiceDelta{ReasoningContent: event.Text}); err != nil {
 					return err
 				}
-				writer.Flush()
-			case dto.StreamMessageTypeStream:
-				var reply string
-				if msg.Token != nil {
-					reply = *msg.Token
+			case chatEventFile:
+				if stlval.DerefPtrOr(event.Msg.SHA) == "" {
+					continue
 				}
-				data, err := stlerr.ErrorWith(json.Marshal(&openai.ChatCompletionStreamResponse{
-					ID:      msgID,
-					Object:  "chat.completion",
-					Created: time.Now().Unix(),
-					Model:   convInfo.Model,
-					Choices: []openai.ChatCompletionStreamChoice{
-						{
-							Index: 0,
-							Delta: openai.ChatCompletionStreamChoiceDelta{
-								Role:    "assistant",
-								Content: strings.TrimRight(reply, "\u0000"),
-							},
-						},
-					},
-				}))
-				if err != nil {
+				if err = writeFile(choice, event.Msg); err != nil {
 					return err
 				}
-				_, err = stlerr.ErrorWith(fmt.Fprint(writer, "data: "+string(data)+"\n\n"))
-				if err != nil {
-					return err
+			case chatEventTool:
+				if !chatCtx.req.ToolEvents {
+					continue
 				}
-				writer.Flush()
-			case dto.StreamMessageTypeReasoning:
-				var reply string
-				if msg.Token != nil {
-					reply = *msg.Token
-				}
-				data, err := stlerr.ErrorWith(json.Marshal(&openai.ChatCompletionStreamResponse{
-					ID:      msgID,
-					Object:  "chat.completion",
-					Created: time.Now().Unix(),
-					Model:   convInfo.Model,
-					Choices: []openai.ChatCompletionStreamChoice{
-						{
-							Index: 0,
-							Delta: openai.ChatCompletionStreamChoiceDelta{
-								Role:             "assistant",
-								ReasoningContent: strings.TrimRight(reply, "\u0000"),
-							},
-						},
-					},
-				}))
-				if err != nil {
+				toolEvent := newChatToolEvent(event.Msg)
+				toolEvent.Index = choice.index
+				if err = enc.Event("tool", toolEvent); err != nil {
 					return err
 				}
-				_, err = stlerr.ErrorWith(fmt.Fprint(writer, "data: "+string(data)+"\n\n"))
-				if err != nil {
-					return err
-				}
-				writer.Flush()
-			case dto.StreamMessageTypeStatus, dto.StreamMessageTypeTool, dto.StreamMessageTypeFile, dto.StreamMessageTypeTitle:
-			default:
-				_ = config.Logger.Warnf("unknown stream msg type `%s`", msg.Type)
 			}
 		}
+
+		finishReason := reader.FinishReason.OpenAI()
+		rest, toolCalls := toolParser.Finish()
+		replyBuffer.WriteString(rest)
+		if err := enc.Delta(choice.index, openai.ChatCompletionStreamChoiceDelta{Content: rest}); err != nil {
+			return err
+		}
+		for i, call := range toolCalls {
+			call.Index = stlval.Ptr(i)
+			if err := enc.Delta(choice.index, openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{call}}); err != nil {
+				return err
+			}
+			finishReason = openai.FinishReasonToolCalls
+		}
+
+		chatCtx.Save(choice, openai.ChatCompletionMessage{
+			Role:             "assistant",
+			Content:          replyBuffer.String(),
+			ToolCalls:        toolCalls,
+			ReasoningContent: reader.Reasoning.String(),
+		})
+
+		if len(reader.Sources) > 0 {
+			if err := enc.CustomDelta(choice.index, &chatCompletionStreamAnnotationsDelta{
+				Annotations: buildURLCitations(replyBuffer.String(), reader.Sources),
+			}); err != nil {
+				return err
+			}
+		}
+		return enc.Finish(choice.index, finishReason)
+	}
+
+	err := chatCtx.Run(streamChoice, func(err error) {
+		// 已经开始输出，只能通过error数据告知客户端，之后其他回复的输出都会失败
+		_ = enc.Error(err)
+	})
+	if err != nil {
+		return err
+	}
+
+	if chatCtx.req.StreamOptions != nil && chatCtx.req.StreamOptions.IncludeUsage {
+		if err := enc.Usage(chatCtx.Usage()); err != nil {
+			return err
+		}
 	}
+	return enc.Done()
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+type chatEventType int
+
+const (
+	chatEventText chatEventType = iota
+	chatEventReasoning
+	chatEventFile
+	chatEventTool
+)
+
+// chatEvent 从HuggingChat消息流中读取出的输出片段
+type chatEvent struct {
+	Type chatEventType
+	Text string
+	Msg  *dto.StreamMessage
+}
+
+type chatFinishReason string
+
+const (
+	chatFinishReasonStop         chatFinishReason = "stop"
+	chatFinishReasonLength       chatFinishReason = "length"
+	chatFinishReasonStopSequence chatFinishReason = "stop_sequence"
+)
+
+// chatReaderOptions 输出限制
+type chatReaderOptions struct {
+	StopSequences []string
+	MaxTokens     int
+	ReasoningMode reasoningMode
+	Tokenizer     tokenizer.Tokenizer // 为空时按字符估算
+	Abort         func()              // 提前结束时调用，用于停止HuggingChat的生成
+}
+
+// chatReader 读取HuggingChat消息流，处理停止序列和最大token数
+type chatReader struct {
+	msgChan   chan *dto.StreamMessage
+	opts      chatReaderOptions
+	stop      *stopSequenceMatcher
+	reasoning *reasoningPipeline
+	tokens    *tokenizer.Counter
+
+	pending  []*chatEvent
+	streamed bool
+	done     bool
+
+	Tokens       int
+	FinishReason chatFinishReason
+	StopSequence string
+	Text         strings.Builder
+	Reasoning    strings.Builder
+	Sources      []*dto.WebSearchSource // 网络搜索的来源
+}
+
+func newChatReader(msgChan chan *dto.StreamMessage, opts chatReaderOptions) *chatReader {
+	if opts.Tokenizer == nil {
+		opts.Tokenizer = tokenizer.Estimator{}
+	}
+	return &chatReader{
+		msgChan:      msgChan,
+		opts:         opts,
+		stop:         newStopSequenceMatcher(opts.StopSequences),
+		reasoning:    newReasoningPipeline(opts.ReasoningMode, opts.Tokenizer),
+		tokens:       tokenizer.NewCounter(opts.Tokenizer),
+		FinishReason: chatFinishReasonStop,
+	}
+}
+
+// Truncated 输出是否在HuggingChat生成结束前被截断
+func (r *chatReader) Truncated() bool {
+	return r.FinishReason != chatFinishReasonStop
+}
+
+// Next 返回下一个输出片段，消息流结束时返回nil
+func (r *chatReader) Next(ctx context.Context) (*chatEvent, error) {
+	for {
+		if len(r.pending) > 0 {
+			event := r.pending[0]
+			r.pending = r.pending[1:]
+			switch event.Type {
+			case chatEventText:
+				r.Text.WriteString(event.Text)
+			case chatEventReasoning:
+				r.Reasoning.WriteString(event.Text)
+			}
+			return event, nil
+		} else if r.done {
+			return nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			r.abort()
+			return nil, stlerr.Errorf("client disconnected")
+		case msg, ok := <-r.msgChan:
+			if !ok {
+				r.flush()
+				r.done = true
+				continue
+			}
+			switch msg.Type {
+			case dto.StreamMessageTypeError:
+				r.finish()
+				return nil, msg.Error
+			case dto.StreamMessageTypeStream:
+				r.streamed = true
+				r.feedText(strings.TrimRight(stlval.DerefPtrOr(msg.Token), "\u0000"), false)
+			case dto.StreamMessageTypeFinalAnswer:
+				if !r.streamed {
+					r.feedText(stlval.DerefPtrOr(msg.Text), false)
+				}
+				if !r.done {
+					r.flush()
+					r.finish()
+				}
+			case dto.StreamMessageTypeReasoning:
+				r.feedText(strings.TrimRight(stlval.DerefPtrOr(msg.Token), "\u0000"), true)
+			case dto.StreamMessageTypeFile:
+				r.pending = append(r.pending, &chatEvent{Type: chatEventFile, Msg: msg})
+			case dto.StreamMessageTypeTool:
+				r.pending = append(r.pending, &chatEvent{Type: chatEventTool, Msg: msg})
+			case dto.StreamMessageTypeWebSearch:
+				if stlval.DerefPtrOr(msg.SubType) == dto.StreamMessageSubTypeSources {
+					r.Sources = msg.Sources
+				}
+			case dto.StreamMessageTypeStatus, dto.StreamMessageTypeTitle:
+			default:
+				_ = config.Logger.Warnf("unknown stream msg type `%s`", msg.Type)
+			}
+		}
+	}
+}
+
+// ReadAll 读取全部输出
+func (r *chatReader) ReadAll(ctx context.Context) ([]*chatEvent, error) {
+	var events []*chatEvent
+	for {
+		event, err := r.Next(ctx)
+		if err != nil {
+			return nil, err
+		} else if event == nil {
+			return events, nil
+		}
+		events = append(events, event)
+	}
+}
+
+// ReasoningTokens 推理内容的token数
+func (r *chatReader) ReasoningTokens() int {
+	return r.reasoning.Tokens
+}
+
+// feedText 输入HuggingChat返回的片段，isReasoning表示片段来自单独返回的推理内容
+func (r *chatReader) feedText(text string, isReasoning bool) {
+	if r.done || text == "" {
+		return
+	}
+	text, truncated := r.tokens.Feed(text, r.opts.MaxTokens)
+	r.Tokens = r.tokens.Count()
+	if isReasoning {
+		r.pushOutput(r.reasoning.Reasoning(text))
+	} else {
+		r.pushOutput(r.reasoning.Stream(text))
+	}
+	if truncated && !r.done {
+		r.flush()
+		if !r.done {
+			r.FinishReason = chatFinishReasonLength
+			r.abort()
+		}
+	}
+}
+
+func (r *chatReader) pushOutput(out reasoningOutput) {
+	if out.Reasoning != "" {
+		r.pending = append(r.pending, &chatEvent{Type: chatEventReasoning, Text: out.Reasoning})
+	}
+	text, seq, stopped := r.stop.Feed(out.Content)
+	r.pushText(text)
+	if stopped {
+		r.FinishReason, r.StopSequence = chatFinishReasonStopSequence, seq
+		r.abort()
+	}
+}
+
+// flush 输出暂扣的文本
+func (r *chatReader) flush() {
+	r.pushOutput(r.reasoning.Flush())
+	r.pushText(r.stop.Flush())
+}
+
+func (r *chatReader) pushText(text string) {
+	if text == "" {
+		return
+	}
+	r.pending = append(r.pending, &chatEvent{Type: chatEventText, Text: text})
+}
+
+// abort 提前停止读取，并停止HuggingChat的生成
+func (r *chatReader) abort() {
+	if r.done {
+		return
+	}
+	r.finish()
+	if r.opts.Abort != nil {
+		r.opts.Abort()
+	}
+}
+
+// finish 停止读取，剩余的消息在后台丢弃
+func (r *chatReader) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	go func() {
+		for range r.msgChan {
+		}
+	}()
+}
+
+// stopSequenceMatcher 在流式文本中查找停止序列，可能构成停止序列前缀的文本会被暂扣
+type stopSequenceMatcher struct {
+	sequences []string
+	pending   string
+}
+
+func newStopSequenceMatcher(sequences []string) *stopSequenceMatcher {
+	var seqs []string
+	for _, seq := range sequences {
+		if seq != "" {
+			seqs = append(seqs, seq)
+		}
+	}
+	return &stopSequenceMatcher{sequences: seqs}
+}
+
+// Feed 输入文本，返回可以输出的文本；命中停止序列时返回命中的序列
+func (m *stopSequenceMatcher) Feed(text string) (string, string, bool) {
+	if len(m.sequences) == 0 {
+		return text, "", false
+	}
+	m.pending += text
+
+	matchIdx, matchSeq := -1, ""
+	for _, seq := range m.sequences {
+		if idx := strings.Index(m.pending, seq); idx >= 0 && (matchIdx < 0 || idx < matchIdx) {
+			matchIdx, matchSeq = idx, seq
+		}
+	}
+	if matchIdx >= 0 {
+		out := m.pending[:matchIdx]
+		m.pending = ""
+		return out, matchSeq, true
+	}
+
+	keep := 0
+	for _, seq := range m.sequences {
+		for i := min(len(seq)-1, len(m.pending)); i > keep; i-- {
+			if strings.HasSuffix(m.pending, seq[:i]) {
+				keep = i
+				break
+			}
+		}
+	}
+	out := m.pending[:len(m.pending)-keep]
+	m.pending = m.pending[len(m.pending)-keep:]
+	return out, "", false
+}
+
+// Flush 返回暂扣的文本
+func (m *stopSequenceMatcher) Flush() string {
+	out := m.pending
+	m.pending = ""
+	return out
+}
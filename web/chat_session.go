@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+const chatMessageRoleDeveloper = "developer"
+
+// conversationLocks 按conversationKey串行开启对话，避免并发请求各自新建会话
+var conversationLocks = &keyedMutex{locks: make(map[string]*keyedMutexEntry)}
+
+type keyedMutexEntry struct {
+	lock sync.Mutex
+	refs int
+}
+
+// keyedMutex 按键区分的互斥锁，没有使用者的键会被移除
+type keyedMutex struct {
+	lock  sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+// Lock 锁定key，返回解锁函数
+func (km *keyedMutex) Lock(key string) func() {
+	km.lock.Lock()
+	entry, ok := km.locks[key]
+	if !ok {
+		entry = new(keyedMutexEntry)
+		km.locks[key] = entry
+	}
+	entry.refs++
+	km.lock.Unlock()
+
+	entry.lock.Lock()
+	return func() {
+		entry.lock.Unlock()
+		km.lock.Lock()
+		defer km.lock.Unlock()
+		if entry.refs--; entry.refs == 0 {
+			delete(km.locks, key)
+		}
+	}
+}
+
+// chatTurn 一轮对话在HuggingChat会话中的位置
+type chatTurn struct {
+	owner     string // 会话所有者，同时区分请求方和访问HuggingChat的账号
+	account   string // 访问HuggingChat的凭证
+	fileOwner string // 消息中引用的文件的所有者，为请求携带的凭证
+	files     chatFileParts
+	sessKey   string
+	convKey   string
+	toolsHash string
+	cli       *hugchat.Client
+	cancel    context.CancelFunc
+	abortOnce *sync.Once // 可能被多个goroutine同时停止
+
+	Model          string
+	SystemPrompt   string
+	ConversationID string
+	ParentID       string
+	UserMessageID  string                         // 本轮发送的用户消息ID，发送后记录
+	History        []openai.ChatCompletionMessage // 包含本轮消息在内的完整历史
+	Messages       []openai.ChatCompletionMessage // 本轮需要发送的消息
+	Continued      bool                           // 是否接续已有的对话
+	Reused         bool                           // 是否复用了已有的HuggingChat会话
+	IncludeTools   bool                           // 是否需要重新发送工具定义
+	WebSearch      bool                           // 是否启用HuggingChat的网络搜索
+	Tools          []string                       // 启用的HuggingChat工具ID
+}
+
+// resolveChatTurn 查找与消息历史匹配的会话，找不到时在系统提示词对应的会话中开启新的对话
+func resolveChatTurn(ctx context.Context, cli *hugchat.Client, auth *requestAuth, model string, msgs []openai.ChatCompletionMessage, files chatFileParts, toolsHash string) (*chatTurn, error) {
+	owner := auth.SessionOwner()
+	sysPrompt := systemPrompt(msgs)
+	turn := &chatTurn{
+		owner:        owner,
+		account:      auth.Credential,
+		fileOwner:    auth.Token,
+		files:        files,
+		convKey:      conversationKey(owner, model, sysPrompt),
+		toolsHash:    toolsHash,
+		Model:        model,
+		SystemPrompt: sysPrompt,
+		History:      msgs,
+	}
+
+	for i := len(msgs) - 1; i > 0; i-- {
+		if msgs[i-1].Role != openai.ChatMessageRoleAssistant {
+			continue
+		}
+		key := sessionKey(owner, model, msgs[:i], files)
+		sess, ok := globalSessionStore.Get(key)
+		if !ok {
+			continue
+		}
+		turn.sessKey = key
+		turn.ConversationID = sess.ConversationID
+		turn.ParentID = sess.MessageID
+		turn.Messages = nonSystemMessages(msgs[i:])
+		turn.Continued = true
+		turn.Reused = true
+		turn.IncludeTools = toolsHash != sess.ToolsHash
+		return turn, nil
+	}
+	return turn, turn.startConversation(ctx, cli, false)
+}
+
+// newChatTurnAt 在指定的会话消息之后开启一轮对话
+func newChatTurnAt(auth *requestAuth, model string, convID string, parentID string, msgs []openai.ChatCompletionMessage) *chatTurn {
+	return &chatTurn{
+		owner:          auth.SessionOwner(),
+		account:        auth.Credential,
+		fileOwner:      auth.Token,
+		Model:          model,
+		ConversationID: convID,
+		ParentID:       parentID,
+		History:        msgs,
+		Messages:       nonSystemMessages(msgs),
+		Continued:      true,
+	}
+}
+
+// startConversation 从系统提示词对应会话的根消息开启新的对话分支，forceCreate时总是新建会话
+func (turn *chatTurn) startConversation(ctx context.Context, cli *hugchat.Client, forceCreate bool) error {
+	turn.sessKey = ""
+	turn.Messages = nonSystemMessages(turn.History)
+	turn.Continued = false
+	turn.IncludeTools = turn.toolsHash != ""
+
+	unlock := conversationLocks.Lock(turn.convKey)
+	defer unlock()
+	if forceCreate {
+		globalConversationStore.Delete(turn.convKey)
+	} else {
+		conv, ok := globalConversationStore.Update(turn.convKey, func(conv *systemConversation) *systemConversation {
+			return &systemConversation{
+				ConversationID: conv.ConversationID,
+				RootMessageID:  conv.RootMessageID,
+				Uses:           conv.Uses + 1,
+			}
+		})
+		if ok {
+			turn.ConversationID = conv.ConversationID
+			turn.ParentID = conv.RootMessageID
+			turn.Reused = true
+			return nil
+		}
+	}
+
+	convInfo, err := cli.CreateConversation(ctx, turn.Model, turn.SystemPrompt)
+	if err != nil {
+		return err
+	}
+	turn.ConversationID = convInfo.ConversationID
+	turn.ParentID = stlslices.Last(convInfo.Messages).ID
+	turn.Reused = false
+	globalConversationStore.Set(turn.convKey, &systemConversation{
+		ConversationID: turn.ConversationID,
+		RootMessageID:  turn.ParentID,
+		Uses:           1,
+	})
+	return nil
+}
+
+// Chat 发送本轮消息，接续的会话不可用时回退到新会话
+func (turn *chatTurn) Chat(ctx context.Context, cli *hugchat.Client, buildInputs func(turn *chatTurn) string) (*hugchat.ChatConversationParams, chan *dto.StreamMessage, error) {
+	params, msgChan, err := turn.send(ctx, cli, buildInputs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 兄弟分支依次发送，发送后立即记录才能区分各分支的用户消息
+	turn.UserMessageID, err = turn.findUserMessageID(ctx, cli, params.Inputs)
+	if err != nil {
+		_ = config.Logger.Warnf("find user message in conversation `%s` failed: %s", turn.ConversationID, err.Error())
+	}
+	return params, msgChan, nil
+}
+
+func (turn *chatTurn) send(ctx context.Context, cli *hugchat.Client, buildInputs func(turn *chatTurn) string) (*hugchat.ChatConversationParams, chan *dto.StreamMessage, error) {
+	// 生成可以被Abort单独取消
+	chatCtx, cancel := context.WithCancel(ctx)
+	turn.cli, turn.cancel, turn.abortOnce = cli, cancel, new(sync.Once)
+
+	var files []*dto.ConversationFile
+	var err error
+	turn.Messages, files, err = prepareMessageFiles(ctx, cli, turn.fileOwner, turn.Model, turn.Messages, turn.files)
+	if err != nil {
+		return nil, nil, err
+	}
+	params := &hugchat.ChatConversationParams{
+		LastMsgID: turn.ParentID,
+		Inputs:    buildInputs(turn),
+		WebSearch: turn.WebSearch,
+		Tools:     turn.Tools,
+		Files:     files,
+	}
+	msgChan, err := cli.ChatConversation(chatCtx, turn.ConversationID, params)
+	if err == nil || !turn.Reused {
+		return params, msgChan, err
+	}
+
+	_ = config.Logger.Warnf("reuse conversation `%s` failed, create a new one: %s", turn.ConversationID, err.Error())
+	if turn.sessKey != "" {
+		globalSessionStore.Delete(turn.sessKey)
+	}
+	if err = turn.startConversation(ctx, cli, true); err != nil {
+		return nil, nil, err
+	}
+	if turn.Messages, files, err = prepareMessageFiles(ctx, cli, turn.fileOwner, turn.Model, turn.Messages, turn.files); err != nil {
+		return nil, nil, err
+	}
+	params = &hugchat.ChatConversationParams{
+		LastMsgID: turn.ParentID,
+		Inputs:    buildInputs(turn),
+		WebSearch: turn.WebSearch,
+		Tools:     turn.Tools,
+		Files:     files,
+	}
+	msgChan, err = cli.ChatConversation(chatCtx, turn.ConversationID, params)
+	return params, msgChan, err
+}
+
+// Branch 复制一轮对话，用于在同一父消息下生成兄弟分支
+func (turn *chatTurn) Branch() *chatTurn {
+	branch := *turn
+	branch.cli, branch.cancel, branch.abortOnce = nil, nil, nil
+	return &branch
+}
+
+// PromptTokens 完整消息历史作为提示词的token数，extra为额外拼接到提示词中的文本
+func (turn *chatTurn) PromptTokens(extra ...string) int {
+	return countMessagesTokens(tokenizer.ForModel(turn.Model), turn.History, extra...)
+}
+
+// Abort 停止HuggingChat的生成，用于输出达到限制后提前结束
+func (turn *chatTurn) Abort() {
+	if turn.abortOnce == nil {
+		return
+	}
+	turn.abortOnce.Do(turn.stopGenerating)
+}
+
+func (turn *chatTurn) stopGenerating() {
+	turn.cancel()
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				_ = config.Logger.Error(err)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := turn.cli.StopGenerating(ctx, turn.ConversationID); err != nil {
+			_ = config.Logger.Warnf("stop generating in conversation `%s` failed: %s", turn.ConversationID, err.Error())
+		}
+	}()
+}
+
+// findUserMessageID 查找刚发送的用户消息，即父消息下内容与inputs相同的最新子消息
+func (turn *chatTurn) findUserMessageID(ctx context.Context, cli *hugchat.Client, inputs string) (string, error) {
+	convInfo, err := cli.ConversationInfo(ctx, turn.ConversationID)
+	if err != nil {
+		return "", err
+	}
+	msgs := make(map[string]*dto.Message, len(convInfo.Messages))
+	for _, msg := range convInfo.Messages {
+		msgs[msg.ID] = msg
+	}
+	parent, ok := msgs[turn.ParentID]
+	if !ok || len(parent.Children) == 0 {
+		return "", stlerr.Errorf("not found user message, conversation=%s, parent=%s", turn.ConversationID, turn.ParentID)
+	}
+	for i := len(parent.Children) - 1; i >= 0; i-- {
+		if msg, ok := msgs[parent.Children[i]]; ok && strings.TrimSpace(msg.Content) == strings.TrimSpace(inputs) {
+			return msg.ID, nil
+		}
+	}
+	return stlslices.Last(parent.Children), nil
+}
+
+// ReplyMessageID 查询本轮助手回复的消息ID
+func (turn *chatTurn) ReplyMessageID(ctx context.Context, cli *hugchat.Client) (string, error) {
+	convInfo, err := cli.ConversationInfo(ctx, turn.ConversationID)
+	if err != nil {
+		return "", err
+	}
+	replyID, ok := findReplyMessageID(convInfo, turn.ParentID, turn.UserMessageID)
+	if !ok {
+		return "", stlerr.Errorf("not found reply message, conversation=%s, parent=%s", turn.ConversationID, turn.ParentID)
+	}
+	return replyID, nil
+}
+
+// Save 记录助手回复对应的消息ID，以便下一轮请求接续。
+// 输出被停止序列或最大token数截断时不记录，HuggingChat保存的回复包含截断之后生成的内容，与客户端收到的不一致
+func (turn *chatTurn) Save(cli *hugchat.Client, reader *chatReader, reply openai.ChatCompletionMessage) {
+	if reader.Truncated() {
+		return
+	}
+	history := append(stlslices.Clone(turn.History), reply)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				_ = config.Logger.Error(err)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		replyID, err := turn.ReplyMessageID(ctx, cli)
+		if err != nil {
+			_ = config.Logger.Error(err)
+			return
+		}
+		globalSessionStore.Set(sessionKey(turn.owner, turn.Model, history, turn.files), &chatSession{
+			ConversationID: turn.ConversationID,
+			MessageID:      replyID,
+			ToolsHash:      turn.toolsHash,
+		})
+	}()
+}
+
+// findChildMessageID 查找消息最新的子消息
+func findChildMessageID(convInfo *dto.ConversationInfo, parentID string) (string, bool) {
+	parent, ok := stlslices.FindFirst(convInfo.Messages, func(_ int, msg *dto.Message) bool {
+		return msg.ID == parentID
+	})
+	if !ok || len(parent.Children) == 0 {
+		return "", false
+	}
+	return stlslices.Last(parent.Children), true
+}
+
+// findReplyMessageID 查找用户消息最新的助手回复，没有记录用户消息时返回父消息下最新一轮对话的助手回复
+func findReplyMessageID(convInfo *dto.ConversationInfo, parentID string, userMsgID string) (string, bool) {
+	if userMsgID != "" {
+		return findChildMessageID(convInfo, userMsgID)
+	}
+	userMsgID, ok := findChildMessageID(convInfo, parentID)
+	if !ok {
+		return "", false
+	}
+	return findChildMessageID(convInfo, userMsgID)
+}
+
+func isSystemMessage(msg openai.ChatCompletionMessage) bool {
+	return msg.Role == openai.ChatMessageRoleSystem || msg.Role == chatMessageRoleDeveloper
+}
+
+// systemPrompt 合并消息中的system和developer消息作为会话的系统提示词
+func systemPrompt(msgs []openai.ChatCompletionMessage) string {
+	prompts := stlslices.Map(stlslices.Filter(msgs, func(_ int, msg openai.ChatCompletionMessage) bool {
+		return isSystemMessage(msg)
+	}), func(_ int, msg openai.ChatCompletionMessage) string {
+		return strings.TrimSpace(messageText(msg))
+	})
+	return strings.Join(prompts, "\n\n")
+}
+
+func nonSystemMessages(msgs []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	return stlslices.Filter(msgs, func(_ int, msg openai.ChatCompletionMessage) bool {
+		return !isSystemMessage(msg)
+	})
+}
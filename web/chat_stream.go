@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	stlerr "github.com/kkkunny/stl/error"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+)
+
+// chatCompletionChunk 流式聊天补全的数据块，go-openai的结构体会把未结束的finish_reason输出为空字符串而不是null
+type chatCompletionChunk struct {
+	ID      string                      `json:"id"`
+	Object  string                      `json:"object"`
+	Created int64                       `json:"created"`
+	Model   string                      `json:"model"`
+	Choices []chatCompletionChunkChoice `json:"choices"`
+	Usage   *openai.Usage               `json:"usage,omitempty"`
+}
+
+type chatCompletionChunkChoice struct {
+	Index        int                  `json:"index"`
+	Delta        any                  `json:"delta"`
+	FinishReason *openai.FinishReason `json:"finish_reason"`
+}
+
+// chatCompletionStreamRoleDelta 每个回复第一个数据块的delta，只包含角色
+type chatCompletionStreamRoleDelta struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chatCompletionStreamPartsDelta 以内容部分列表作为content的delta，用于输出生成的文件
+type chatCompletionStreamPartsDelta struct {
+	Content []openai.ChatMessagePart `json:"content"`
+}
+
+// chatCompletionStreamAnnotationsDelta 输出网络搜索来源的delta
+type chatCompletionStreamAnnotationsDelta struct {
+	Annotations []*messageAnnotation `json:"annotations"`
+}
+
+// chatCompletionStreamEncoder 按OpenAI的流式格式输出聊天补全：
+// 每个回复先输出只包含角色的数据块，之后的数据块不再重复角色，最后以带finish_reason的空delta结束；
+// 所有数据块使用相同的id和created，出错时输出error数据后关闭，不再输出[DONE]。
+// 可以被多个回复并发调用
+type chatCompletionStreamEncoder struct {
+	writer  *echo.Response
+	id      string
+	created int64
+	model   string
+
+	lock     sync.Mutex
+	started  map[int]bool
+	finished map[int]bool
+	closed   bool
+}
+
+func newChatCompletionStreamEncoder(writer *echo.Response, id string, model string) *chatCompletionStreamEncoder {
+	setSSEHeaders(writer)
+	return &chatCompletionStreamEncoder{
+		writer:   writer,
+		id:       id,
+		created:  time.Now().Unix(),
+		model:    model,
+		started:  make(map[int]bool),
+		finished: make(map[int]bool),
+	}
+}
+
+// Delta 输出一个回复的增量内容
+func (enc *chatCompletionStreamEncoder) Delta(index int, delta openai.ChatCompletionStreamChoiceDelta) error {
+	delta.Role = ""
+	if delta.Content == "" && delta.ReasoningContent == "" && len(delta.ToolCalls) == 0 && delta.FunctionCall == nil && delta.Refusal == "" {
+		return nil
+	}
+	return enc.CustomDelta(index, delta)
+}
+
+// CustomDelta 输出go-openai不支持的delta
+func (enc *chatCompletionStreamEncoder) CustomDelta(index int, delta any) error {
+	enc.lock.Lock()
+	defer enc.lock.Unlock()
+
+	if err := enc.start(index); err != nil {
+		return err
+	} else if enc.finished[index] {
+		return stlerr.Errorf("choice %d has already finished", index)
+	}
+	return enc.writeChoice(index, delta, nil)
+}
+
+// Finish 结束一个回复
+func (enc *chatCompletionStreamEncoder) Finish(index int, reason openai.FinishReason) error {
+	enc.lock.Lock()
+	defer enc.lock.Unlock()
+
+	if err := enc.start(index); err != nil {
+		return err
+	} else if enc.finished[index] {
+		return stlerr.Errorf("choice %d has already finished", index)
+	}
+	enc.finished[index] = true
+	return enc.writeChoice(index, struct{}{}, &reason)
+}
+
+// Event 输出带事件名的扩展数据
+func (enc *chatCompletionStreamEncoder) Event(event string, data any) error {
+	enc.lock.Lock()
+	defer enc.lock.Unlock()
+
+	if enc.closed {
+		return stlerr.Errorf("stream has been closed")
+	}
+	return writeSSEEvent(enc.writer, event, data)
+}
+
+// Usage 输出choices为空、包含token用量的数据块
+func (enc *chatCompletionStreamEncoder) Usage(usage *openai.Usage) error {
+	enc.lock.Lock()
+	defer enc.lock.Unlock()
+
+	return enc.write(&chatCompletionChunk{
+		ID:      enc.id,
+		Object:  "chat.completion.chunk",
+		Created: enc.created,
+		Model:   enc.model,
+		Choices: []chatCompletionChunkChoice{},
+		Usage:   usage,
+	})
+}
+
+// Done 输出[DONE]并关闭
+func (enc *chatCompletionStreamEncoder) Done() error {
+	enc.lock.Lock()
+	defer enc.lock.Unlock()
+
+	if enc.closed {
+		return stlerr.Errorf("stream has been closed")
+	}
+	enc.closed = true
+	return writeSSERaw(enc.writer, "[DONE]")
+}
+
+// Error 输出错误并关闭，官方SDK读到error字段时会抛出异常
+func (enc *chatCompletionStreamEncoder) Error(err error) error {
+	enc.lock.Lock()
+	defer enc.lock.Unlock()
+
+	if enc.closed {
+		return nil
+	}
+	enc.closed = true
+	_, body := newOpenAIError(err)
+	return writeSSEData(enc.writer, &openAIErrorResponse{Error: body})
+}
+
+// start 回复还未输出过数据块时先输出角色
+func (enc *chatCompletionStreamEncoder) start(index int) error {
+	if enc.started[index] {
+		return nil
+	}
+	enc.started[index] = true
+	return enc.writeChoice(index, &chatCompletionStreamRoleDelta{Role: openai.ChatMessageRoleAssistant}, nil)
+}
+
+func (enc *chatCompletionStreamEncoder) writeChoice(index int, delta any, finishReason *openai.FinishReason) error {
+	return enc.write(&chatCompletionChunk{
+		ID:      enc.id,
+		Object:  "chat.completion.chunk",
+		Created: enc.created,
+		Model:   enc.model,
+		Choices: []chatCompletionChunkChoice{{Index: index, Delta: delta, FinishReason: finishReason}},
+	})
+}
+
+func (enc *chatCompletionStreamEncoder) write(chunk *chatCompletionChunk) error {
+	if enc.closed {
+		return stlerr.Errorf("stream has been closed")
+	}
+	return writeSSEData(enc.writer, chunk)
+}
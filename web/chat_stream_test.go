@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/internal/api"
+)
+
+var updateFixtures = flag.Bool("update", false, "rewrite the recorded stream fixtures in testdata")
+
+const (
+	testStreamID      = "chatcmpl-test"
+	testStreamCreated = 1700000000
+	testStreamModel   = "test-model"
+)
+
+// streamChoice go-openai解析出的一个回复
+type streamChoice struct {
+	content      string
+	toolCalls    []openai.ToolCall
+	finishReason openai.FinishReason
+}
+
+// streamResult go-openai解析出的整个流
+type streamResult struct {
+	choices map[int]*streamChoice
+	usage   *openai.Usage
+	err     error
+}
+
+// recordStream 使用编码器输出并与testdata中记录的数据比较，-update时重新记录
+func recordStream(t *testing.T, name string, write func(enc *chatCompletionStreamEncoder)) []byte {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	reqCtx := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil), rec)
+	enc := newChatCompletionStreamEncoder(reqCtx.Response(), testStreamID, testStreamModel)
+	enc.created = testStreamCreated
+	write(enc)
+	if contentType := rec.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", contentType)
+	}
+
+	path := filepath.Join("testdata", "chat_stream", name+".sse")
+	if *updateFixtures {
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, rec.Body.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read fixture: %v (run with -update to record it)", err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Fatalf("encoder output differs from %s\ngot:\n%s\nwant:\n%s", path, rec.Body.String(), want)
+	}
+	return want
+}
+
+// parseStream 用go-openai的流式客户端解析记录的数据
+func parseStream(t *testing.T, data []byte) *streamResult {
+	t.Helper()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write(data)
+	}))
+	defer svr.Close()
+
+	cfg := openai.DefaultConfig("test")
+	cfg.BaseURL = svr.URL + "/v1"
+	stream, err := openai.NewClientWithConfig(cfg).CreateChatCompletionStream(context.Background(), openai.ChatCompletionRequest{
+		Model:    testStreamModel,
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		Stream:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	result := &streamResult{choices: make(map[int]*streamChoice)}
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return result
+		} else if err != nil {
+			result.err = err
+			return result
+		}
+
+		if chunk.ID != testStreamID || chunk.Created != testStreamCreated || chunk.Object != "chat.completion.chunk" || chunk.Model != testStreamModel {
+			t.Fatalf("unexpected chunk header: id=%s created=%d object=%s model=%s", chunk.ID, chunk.Created, chunk.Object, chunk.Model)
+		}
+		if chunk.Usage != nil {
+			if len(chunk.Choices) != 0 {
+				t.Fatalf("usage chunk has %d choices, want 0", len(chunk.Choices))
+			}
+			result.usage = chunk.Usage
+		}
+		for _, c := range chunk.Choices {
+			choice, ok := result.choices[c.Index]
+			if !ok {
+				if c.Delta.Role != openai.ChatMessageRoleAssistant {
+					t.Fatalf("first chunk of choice %d has role %q, want assistant", c.Index, c.Delta.Role)
+				}
+				choice = &streamChoice{}
+				result.choices[c.Index] = choice
+			} else if c.Delta.Role != "" {
+				t.Fatalf("choice %d repeats role in a later chunk", c.Index)
+			}
+			if choice.finishReason != "" {
+				t.Fatalf("choice %d has chunks after finish_reason", c.Index)
+			}
+			choice.content += c.Delta.Content
+			for _, call := range c.Delta.ToolCalls {
+				index := stlval.DerefPtrOr(call.Index)
+				if index == len(choice.toolCalls) {
+					choice.toolCalls = append(choice.toolCalls, call)
+				} else {
+					choice.toolCalls[index].Function.Arguments += call.Function.Arguments
+				}
+			}
+			choice.finishReason = c.FinishReason
+		}
+	}
+}
+
+func TestChatCompletionStreamSingleChoice(t *testing.T) {
+	data := recordStream(t, "single_choice", func(enc *chatCompletionStreamEncoder) {
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{Content: "Hello"})
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{})
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{Content: ", world"})
+		_ = enc.Finish(0, openai.FinishReasonStop)
+		_ = enc.Done()
+	})
+
+	result := parseStream(t, data)
+	if result.err != nil {
+		t.Fatal(result.err)
+	} else if len(result.choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(result.choices))
+	}
+	choice := result.choices[0]
+	if choice.content != "Hello, world" || choice.finishReason != openai.FinishReasonStop {
+		t.Fatalf("got content=%q finish_reason=%q", choice.content, choice.finishReason)
+	}
+}
+
+func TestChatCompletionStreamMultipleChoices(t *testing.T) {
+	data := recordStream(t, "multiple_choices", func(enc *chatCompletionStreamEncoder) {
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{Content: "Sure! "})
+		_ = enc.Delta(1, openai.ChatCompletionStreamChoiceDelta{Content: "Sure! "})
+		_ = enc.Delta(1, openai.ChatCompletionStreamChoiceDelta{Content: "Second"})
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{Content: "First"})
+		_ = enc.Finish(1, openai.FinishReasonLength)
+		_ = enc.Finish(0, openai.FinishReasonStop)
+		_ = enc.Done()
+	})
+
+	result := parseStream(t, data)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	want := map[int]streamChoice{
+		0: {content: "Sure! First", finishReason: openai.FinishReasonStop},
+		1: {content: "Sure! Second", finishReason: openai.FinishReasonLength},
+	}
+	if len(result.choices) != len(want) {
+		t.Fatalf("got %d choices, want %d", len(result.choices), len(want))
+	}
+	for index, w := range want {
+		got := result.choices[index]
+		if got.content != w.content || got.finishReason != w.finishReason {
+			t.Fatalf("choice %d: got content=%q finish_reason=%q, want content=%q finish_reason=%q", index, got.content, got.finishReason, w.content, w.finishReason)
+		}
+	}
+}
+
+func TestChatCompletionStreamToolCalls(t *testing.T) {
+	data := recordStream(t, "tool_calls", func(enc *chatCompletionStreamEncoder) {
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{{
+			Index:    stlval.Ptr(0),
+			ID:       "call_0",
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+		}}})
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{ToolCalls: []openai.ToolCall{{
+			Index:    stlval.Ptr(1),
+			ID:       "call_1",
+			Type:     openai.ToolTypeFunction,
+			Function: openai.FunctionCall{Name: "get_time", Arguments: `{"zone":"CET"}`},
+		}}})
+		_ = enc.Finish(0, openai.FinishReasonToolCalls)
+		_ = enc.Done()
+	})
+
+	result := parseStream(t, data)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	choice := result.choices[0]
+	if choice.finishReason != openai.FinishReasonToolCalls || choice.content != "" {
+		t.Fatalf("got content=%q finish_reason=%q", choice.content, choice.finishReason)
+	} else if len(choice.toolCalls) != 2 {
+		t.Fatalf("got %d tool calls, want 2", len(choice.toolCalls))
+	}
+	for i, want := range []openai.FunctionCall{{Name: "get_weather", Arguments: `{"city":"Paris"}`}, {Name: "get_time", Arguments: `{"zone":"CET"}`}} {
+		call := choice.toolCalls[i]
+		if call.ID != fmt.Sprintf("call_%d", i) || call.Type != openai.ToolTypeFunction || call.Function != want {
+			t.Fatalf("tool call %d: got %+v", i, call)
+		}
+	}
+}
+
+func TestChatCompletionStreamIncludeUsage(t *testing.T) {
+	data := recordStream(t, "include_usage", func(enc *chatCompletionStreamEncoder) {
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{Content: "Hi"})
+		_ = enc.Finish(0, openai.FinishReasonStop)
+		_ = enc.Usage(&openai.Usage{PromptTokens: 5, CompletionTokens: 1, TotalTokens: 6})
+		_ = enc.Done()
+	})
+
+	result := parseStream(t, data)
+	if result.err != nil {
+		t.Fatal(result.err)
+	} else if result.usage == nil {
+		t.Fatal("no usage chunk")
+	} else if result.usage.PromptTokens != 5 || result.usage.CompletionTokens != 1 || result.usage.TotalTokens != 6 {
+		t.Fatalf("got usage %+v", result.usage)
+	} else if result.choices[0].content != "Hi" {
+		t.Fatalf("got content %q", result.choices[0].content)
+	}
+}
+
+func TestChatCompletionStreamError(t *testing.T) {
+	data := recordStream(t, "error", func(enc *chatCompletionStreamEncoder) {
+		_ = enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{Content: "Partial"})
+		_ = enc.Error(stlerr.ErrorWrap(&api.Error{Kind: api.ErrorKindRateLimited, Message: "too many requests"}))
+		// 出错后流已经关闭，之后的输出都会被拒绝
+		if err := enc.Delta(0, openai.ChatCompletionStreamChoiceDelta{Content: "more"}); err == nil {
+			t.Error("Delta after Error succeeded")
+		}
+		if err := enc.Done(); err == nil {
+			t.Error("Done after Error succeeded")
+		}
+	})
+
+	result := parseStream(t, data)
+	var apiErr *openai.APIError
+	if !errors.As(result.err, &apiErr) {
+		t.Fatalf("got error %v, want *openai.APIError", result.err)
+	} else if apiErr.Type != "rate_limit_error" || apiErr.Code != "rate_limit_exceeded" || apiErr.Message != "too many requests" {
+		t.Fatalf("got error type=%s code=%v message=%s", apiErr.Type, apiErr.Code, apiErr.Message)
+	} else if result.choices[0].content != "Partial" || result.choices[0].finishReason != "" {
+		t.Fatalf("got content=%q finish_reason=%q before the error", result.choices[0].content, result.choices[0].finishReason)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+type completionRequest struct {
+	Model       string     `json:"model"`
+	Prompt      stringList `json:"prompt"`
+	Suffix      string     `json:"suffix,omitempty"`
+	MaxTokens   int        `json:"max_tokens,omitempty"`
+	Stop        stringList `json:"stop,omitempty"`
+	Echo        bool       `json:"echo,omitempty"`
+	Stream      bool       `json:"stream,omitempty"`
+	Temperature *float64   `json:"temperature,omitempty"`
+	TopP        *float64   `json:"top_p,omitempty"`
+}
+
+type completionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	LogProbs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type completionResponse struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []*completionChoice `json:"choices"`
+	Usage   *openai.Usage       `json:"usage,omitempty"`
+}
+
+// completionChunk 单个prompt补全过程中产生的输出
+type completionChunk struct {
+	Index        int
+	Text         string
+	FinishReason *string
+	Tokens       int
+	PromptTokens int
+	Err          error
+}
+
+func completions(reqCtx echo.Context) error {
+	auth, err := newRequestAuth(reqCtx, strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	var req completionRequest
+	if err = stlerr.ErrorWrap(reqCtx.Bind(&req)); err != nil {
+		_ = config.Logger.Error(err)
+		return echo.NewHTTPError(http.StatusBadRequest, "prompt must be a string or an array of strings")
+	}
+	if len(req.Prompt) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "prompt must not be empty")
+	}
+	for _, prompt := range req.Prompt {
+		if prompt == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "prompt must not be empty")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(reqCtx.Request().Context())
+	defer cancel()
+	chunkChan := make(chan *completionChunk)
+	for i, prompt := range req.Prompt {
+		go runCompletion(ctx, cli, auth, &req, i, prompt, chunkChan)
+	}
+
+	resp := &completionResponse{
+		ID:      newRandomID("cmpl-"),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+	if req.Stream {
+		return completionsWithStream(reqCtx, &req, resp, chunkChan)
+	}
+	return completionsNoStream(reqCtx, &req, resp, chunkChan)
+}
+
+// runCompletion 补全单个prompt，每个prompt从复用会话的根消息开启新的分支
+func runCompletion(ctx context.Context, cli *hugchat.Client, auth *requestAuth, req *completionRequest, index int, prompt string, chunkChan chan<- *completionChunk) {
+	send := func(chunk *completionChunk) bool {
+		chunk.Index = index
+		select {
+		case chunkChan <- chunk:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	msgs := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: prompt}}
+	turn, err := resolveChatTurn(ctx, cli, auth, req.Model, msgs, nil, "")
+	if err != nil {
+		send(&completionChunk{Err: err})
+		return
+	}
+	_, msgChan, err := turn.Chat(ctx, cli, func(_ *chatTurn) string {
+		return buildCompletionPrompt(prompt, req.Suffix)
+	})
+	if err != nil {
+		send(&completionChunk{Err: err})
+		return
+	}
+	reader := newChatReader(msgChan, chatReaderOptions{
+		StopSequences: req.Stop,
+		MaxTokens:     req.MaxTokens,
+		ReasoningMode: modelReasoningMode(turn.Model),
+		Tokenizer:     tokenizer.ForModel(turn.Model),
+		Abort:         turn.Abort,
+	})
+
+	if req.Echo && !send(&completionChunk{Text: prompt}) {
+		return
+	}
+	for {
+		event, err := reader.Next(ctx)
+		if err != nil {
+			send(&completionChunk{Err: err})
+			return
+		} else if event == nil {
+			break
+		}
+		if event.Type == chatEventText && !send(&completionChunk{Text: event.Text}) {
+			return
+		}
+	}
+	send(&completionChunk{
+		FinishReason: stlval.Ptr(stlval.Ternary(reader.FinishReason == chatFinishReasonLength, "length", "stop")),
+		Tokens:       reader.Tokens,
+		PromptTokens: tokenizer.Count(tokenizer.ForModel(turn.Model), prompt),
+	})
+}
+
+// buildCompletionPrompt 构造补全的输入，有suffix时要求模型补全中间部分
+func buildCompletionPrompt(prompt string, suffix string) string {
+	if suffix == "" {
+		return prompt
+	}
+	return fmt.Sprintf("Fill in the missing text between <prefix> and <suffix>. Respond ONLY with the missing text.\n<prefix>%s</prefix>\n<suffix>%s</suffix>", prompt, suffix)
+}
+
+func completionsNoStream(reqCtx echo.Context, req *completionRequest, resp *completionResponse, chunkChan chan *completionChunk) error {
+	texts := make([]strings.Builder, len(req.Prompt))
+	resp.Choices = make([]*completionChoice, len(req.Prompt))
+	var tokens, promptTokens int
+	for done := 0; done < len(req.Prompt); {
+		var chunk *completionChunk
+		select {
+		case <-reqCtx.Request().Context().Done():
+			return stlerr.Errorf("client disconnected")
+		case chunk = <-chunkChan:
+		}
+		if chunk.Err != nil {
+			return chunk.Err
+		}
+		texts[chunk.Index].WriteString(chunk.Text)
+		if chunk.FinishReason != nil {
+			resp.Choices[chunk.Index] = &completionChoice{
+				Text:         texts[chunk.Index].String(),
+				Index:        chunk.Index,
+				FinishReason: chunk.FinishReason,
+			}
+			tokens += chunk.Tokens
+			promptTokens += chunk.PromptTokens
+			done++
+		}
+	}
+	resp.Usage = &openai.Usage{PromptTokens: promptTokens, CompletionTokens: tokens, TotalTokens: promptTokens + tokens}
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, resp, "  "))
+}
+
+func completionsWithStream(reqCtx echo.Context, req *completionRequest, resp *completionResponse, chunkChan chan *completionChunk) error {
+	writer := reqCtx.Response()
+	setSSEHeaders(writer)
+
+	for done := 0; done < len(req.Prompt); {
+		var chunk *completionChunk
+		select {
+		case <-reqCtx.Request().Context().Done():
+			return stlerr.Errorf("SSE client disconnected")
+		case chunk = <-chunkChan:
+		}
+		if chunk.Err != nil {
+			_, body := newOpenAIError(chunk.Err)
+			_ = writeSSEData(writer, &openAIErrorResponse{Error: body})
+			return chunk.Err
+		}
+		if chunk.FinishReason != nil {
+			done++
+		}
+		resp.Choices = []*completionChoice{{
+			Text:         chunk.Text,
+			Index:        chunk.Index,
+			FinishReason: chunk.FinishReason,
+		}}
+		if err := writeSSEData(writer, resp); err != nil {
+			return err
+		}
+	}
+	return writeSSERaw(writer, "[DONE]")
+}
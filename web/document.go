@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+)
+
+const (
+	chatMessagePartTypeFile openai.ChatMessagePartType = "file"
+
+	// maxDocumentSize HuggingChat上传文件的大小上限
+	maxDocumentSize = 10 << 20
+	// maxInlineDocumentLength 本地提取的文本内联到提示词中的最大字符数
+	maxInlineDocumentLength = 100000
+)
+
+// chatFilePart file类型的内容部分
+type chatFilePart struct {
+	Filename string `json:"filename,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+}
+
+// chatFileParts 请求中file类型内容部分的内容，按内容部分的地址索引。
+// go-openai不支持file类型的内容部分，消息中只保留类型，复制消息时MultiContent仍指向同一个数组
+type chatFileParts map[*openai.ChatMessagePart]*chatFilePart
+
+// Get 获取内容部分对应的文件，没有记录时返回空的文件
+func (files chatFileParts) Get(part *openai.ChatMessagePart) *chatFilePart {
+	if file, ok := files[part]; ok {
+		return file
+	}
+	return &chatFilePart{}
+}
+
+// Hash 文件内容的摘要，用于匹配会话
+func (part *chatFilePart) Hash() string {
+	return hashString(part.FileID + "\x00" + part.FileData)
+}
+
+// textDocumentMimeTypes 可以直接作为文本内联的文件类型
+var textDocumentMimeTypes = []string{"application/json", "application/xml", "application/x-yaml", "application/yaml", "application/javascript"}
+
+// loadFilePart 读取file内容部分，file_id引用owner通过Files API上传的文件，
+// file_data可以是data URL或者base64编码的文件内容
+func loadFilePart(owner string, part *chatFilePart) (*dto.ConversationFile, error) {
+	if part.FileID != "" {
+		file, content, err := loadStoredFile(owner, part.FileID)
+		if err != nil {
+			return nil, err
+		}
+		return &dto.ConversationFile{Name: stlval.Ternary(part.Filename != "", part.Filename, file.Filename), MIME: file.MIME, Data: content}, nil
+	}
+
+	name := part.Filename
+	data := part.FileData
+	var mimeType string
+	if strings.HasPrefix(data, "data:") {
+		var meta string
+		var ok bool
+		meta, data, ok = strings.Cut(strings.TrimPrefix(data, "data:"), ",")
+		if !ok || !strings.HasSuffix(meta, ";base64") {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "file_data must be base64 encoded")
+		}
+		mimeType = strings.TrimSuffix(meta, ";base64")
+	}
+	if data == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "file_data must not be empty")
+	} else if base64.StdEncoding.DecodedLen(len(data)) > maxDocumentSize+2 {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("file `%s` exceeds the upstream limit of %d bytes", name, maxDocumentSize))
+	}
+	content, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("file `%s` is not valid base64", name))
+	}
+	if len(content) > maxDocumentSize {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("file `%s` exceeds the upstream limit of %d bytes", name, maxDocumentSize))
+	}
+
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = documentMimeType(name, content)
+	}
+	if name == "" {
+		name = "document"
+	}
+	return &dto.ConversationFile{Name: name, MIME: mimeType, Data: content}, nil
+}
+
+func documentMimeType(name string, content []byte) string {
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".md", ".markdown":
+		return "text/markdown"
+	case "":
+	default:
+		if mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+			return mimeType
+		}
+	}
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	return mimeType
+}
+
+// extractDocumentText 在本地提取文档文本，用于模型不支持上传该类型文件的情况
+func extractDocumentText(file *dto.ConversationFile) (string, error) {
+	var text string
+	switch {
+	case file.MIME == "application/pdf":
+		var err error
+		text, err = extractPDFText(file.Data)
+		if err != nil {
+			_ = config.Logger.Warnf("extract text from `%s` failed: %s", file.Name, err.Error())
+			return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("cannot extract text from file `%s`", file.Name))
+		}
+	case strings.HasPrefix(file.MIME, "text/") || strings.HasSuffix(file.MIME, "+json") || strings.HasSuffix(file.MIME, "+xml") || slices.Contains(textDocumentMimeTypes, file.MIME):
+		if !utf8.Valid(file.Data) {
+			return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("file `%s` is not valid utf-8 text", file.Name))
+		}
+		text = string(file.Data)
+	default:
+		return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported file type `%s`", file.MIME))
+	}
+
+	if runes := []rune(text); len(runes) > maxInlineDocumentLength {
+		text = string(runes[:maxInlineDocumentLength]) + "\n[truncated]"
+	}
+	return fmt.Sprintf("<document name=\"%s\">\n%s\n</document>", file.Name, text), nil
+}
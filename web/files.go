@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	stlerr "github.com/kkkunny/stl/error"
+	"github.com/labstack/echo/v4"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+)
+
+// maxUploadFileSize 上传文件的大小上限，与HuggingChat上传文件的上限一致
+const maxUploadFileSize = maxDocumentSize
+
+type fileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+func newFileObject(file *storedFile) *fileObject {
+	return &fileObject{
+		ID:        file.ID,
+		Object:    "file",
+		Bytes:     file.Bytes,
+		CreatedAt: file.CreatedAt,
+		Filename:  file.Filename,
+		Purpose:   file.Purpose,
+		Status:    "processed",
+	}
+}
+
+// fileOwner 校验凭证并返回文件所有者标识
+func fileOwner(reqCtx echo.Context) (string, error) {
+	authToken := strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer ")
+	if err := checkAuthorization(authToken); err != nil {
+		_ = config.Logger.Error(err)
+		return "", echo.ErrUnauthorized
+	}
+	return hashString(authToken), nil
+}
+
+// getOwnedFile 获取属于owner的文件，其他凭证上传的文件视为不存在
+func getOwnedFile(owner string, id string) (*storedFile, error) {
+	file, ok := globalFileStore.Get(id)
+	if !ok || file.Owner != owner {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "file `"+id+"` not found")
+	}
+	return file, nil
+}
+
+func uploadFile(reqCtx echo.Context) error {
+	owner, err := fileOwner(reqCtx)
+	if err != nil {
+		return err
+	}
+
+	reqCtx.Request().Body = http.MaxBytesReader(reqCtx.Response(), reqCtx.Request().Body, maxUploadFileSize+1<<20)
+	header, err := reqCtx.FormFile("file")
+	if err != nil {
+		_ = config.Logger.Error(err)
+		return echo.NewHTTPError(http.StatusBadRequest, "file is required")
+	} else if header.Size > maxUploadFileSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "file exceeds the upstream limit of 10MB")
+	}
+	src, err := stlerr.ErrorWith(header.Open())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	content, err := stlerr.ErrorWith(io.ReadAll(src))
+	if err != nil {
+		return err
+	}
+
+	file := &storedFile{
+		ID:        newRandomID("file-"),
+		Owner:     owner,
+		Filename:  header.Filename,
+		Purpose:   reqCtx.FormValue("purpose"),
+		MIME:      documentMimeType(header.Filename, content),
+		Bytes:     int64(len(content)),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err = stlerr.ErrorWrap(os.MkdirAll(fileStoreDir, 0750)); err != nil {
+		return err
+	} else if err = stlerr.ErrorWrap(os.WriteFile(file.Path(), content, 0640)); err != nil {
+		return err
+	}
+	globalFileStore.Set(file.ID, file)
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, newFileObject(file), "  "))
+}
+
+func listFiles(reqCtx echo.Context) error {
+	owner, err := fileOwner(reqCtx)
+	if err != nil {
+		return err
+	}
+
+	purpose := reqCtx.QueryParam("purpose")
+	files := make([]*fileObject, 0)
+	globalFileStore.Range(func(_ string, file *storedFile) bool {
+		if file.Owner == owner && (purpose == "" || file.Purpose == purpose) {
+			files = append(files, newFileObject(file))
+		}
+		return true
+	})
+	slices.SortFunc(files, func(l, r *fileObject) int {
+		return int(r.CreatedAt - l.CreatedAt)
+	})
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, map[string]any{
+		"object":   "list",
+		"data":     files,
+		"has_more": false,
+	}, "  "))
+}
+
+func retrieveFile(reqCtx echo.Context) error {
+	owner, err := fileOwner(reqCtx)
+	if err != nil {
+		return err
+	}
+	file, err := getOwnedFile(owner, reqCtx.Param("id"))
+	if err != nil {
+		return err
+	}
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, newFileObject(file), "  "))
+}
+
+func retrieveFileContent(reqCtx echo.Context) error {
+	owner, err := fileOwner(reqCtx)
+	if err != nil {
+		return err
+	}
+	file, err := getOwnedFile(owner, reqCtx.Param("id"))
+	if err != nil {
+		return err
+	}
+	content, err := stlerr.ErrorWith(os.ReadFile(file.Path()))
+	if err != nil {
+		return err
+	}
+	return stlerr.ErrorWrap(reqCtx.Blob(http.StatusOK, file.MIME, content))
+}
+
+func deleteFile(reqCtx echo.Context) error {
+	owner, err := fileOwner(reqCtx)
+	if err != nil {
+		return err
+	}
+	file, err := getOwnedFile(owner, reqCtx.Param("id"))
+	if err != nil {
+		return err
+	}
+	globalFileStore.Delete(file.ID)
+	if err = os.Remove(file.Path()); err != nil && !os.IsNotExist(err) {
+		_ = config.Logger.Error(stlerr.ErrorWrap(err))
+	}
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, map[string]any{
+		"id":      file.ID,
+		"object":  "file",
+		"deleted": true,
+	}, "  "))
+}
+
+// loadStoredFile 读取owner上传的文件内容
+func loadStoredFile(owner string, id string) (*storedFile, []byte, error) {
+	file, err := getOwnedFile(hashString(owner), id)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := stlerr.ErrorWith(os.ReadFile(file.Path()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, content, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+type geminiPart struct {
+	Text    string `json:"text,omitempty"`
+	Thought bool   `json:"thought,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+// Text 拼接非思考部分的文本
+func (c *geminiContent) Text() string {
+	if c == nil {
+		return ""
+	}
+	texts := stlslices.Map(stlslices.Filter(c.Parts, func(_ int, part geminiPart) bool {
+		return !part.Thought
+	}), func(_ int, part geminiPart) string {
+		return part.Text
+	})
+	return strings.Join(texts, "\n")
+}
+
+type geminiGenerationConfig struct {
+	StopSequences    []string       `json:"stopSequences,omitempty"`
+	MaxOutputTokens  int            `json:"maxOutputTokens,omitempty"`
+	Temperature      *float64       `json:"temperature,omitempty"`
+	TopP             *float64       `json:"topP,omitempty"`
+	TopK             *int           `json:"topK,omitempty"`
+	ResponseMimeType string         `json:"responseMimeType,omitempty"`
+	ResponseSchema   map[string]any `json:"responseSchema,omitempty"`
+}
+
+type geminiGenerateContentRequest struct {
+	Contents          []geminiContent        `json:"contents"`
+	SystemInstruction *geminiContent         `json:"systemInstruction,omitempty"`
+	GenerationConfig  geminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+// ChatMessages 转换为OpenAI格式的消息历史
+func (req *geminiGenerateContentRequest) ChatMessages() []openai.ChatCompletionMessage {
+	msgs := make([]openai.ChatCompletionMessage, 0, len(req.Contents)+1)
+	if system := req.SystemInstruction.Text(); system != "" {
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: system})
+	}
+	for _, content := range req.Contents {
+		role := openai.ChatMessageRoleUser
+		if content.Role == "model" {
+			role = openai.ChatMessageRoleAssistant
+		}
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: role, Content: content.Text()})
+	}
+	return msgs
+}
+
+type geminiCandidate struct {
+	Content      geminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+type geminiUsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+	ThoughtsTokenCount   int `json:"thoughtsTokenCount,omitempty"`
+}
+
+type geminiGenerateContentResponse struct {
+	Candidates    []geminiCandidate    `json:"candidates"`
+	UsageMetadata *geminiUsageMetadata `json:"usageMetadata,omitempty"`
+	ModelVersion  string               `json:"modelVersion"`
+}
+
+type geminiModel struct {
+	Name                       string   `json:"name"`
+	BaseModelID                string   `json:"baseModelId"`
+	DisplayName                string   `json:"displayName"`
+	Description                string   `json:"description"`
+	OutputTokenLimit           int64    `json:"outputTokenLimit,omitempty"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+func geminiAuthToken(reqCtx echo.Context) string {
+	if key := reqCtx.QueryParam("key"); key != "" {
+		return key
+	} else if key = reqCtx.Request().Header.Get("x-goog-api-key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer ")
+}
+
+func newGeminiModel(model *dto.ModelInfo) *geminiModel {
+	return &geminiModel{
+		Name:                       "models/" + model.ID,
+		BaseModelID:                model.ID,
+		DisplayName:                model.Name,
+		Description:                model.Desc,
+		OutputTokenLimit:           model.MaxNewTokens,
+		SupportedGenerationMethods: []string{"generateContent", "streamGenerateContent"},
+	}
+}
+
+func geminiListModels(reqCtx echo.Context) error {
+	auth, err := newRequestAuth(reqCtx, geminiAuthToken(reqCtx))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	models, err := cli.ListModels(reqCtx.Request().Context())
+	if err != nil {
+		return err
+	}
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, map[string]any{
+		"models": stlslices.Map(stlslices.Filter(models, func(_ int, model *dto.ModelInfo) bool {
+			return model.Active
+		}), func(_ int, model *dto.ModelInfo) *geminiModel {
+			return newGeminiModel(model)
+		}),
+	}, "  "))
+}
+
+func geminiGetModel(reqCtx echo.Context) error {
+	auth, err := newRequestAuth(reqCtx, geminiAuthToken(reqCtx))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	models, err := cli.ListModels(reqCtx.Request().Context())
+	if err != nil {
+		return err
+	}
+	modelID := reqCtx.Param("*")
+	model, ok := stlslices.FindFirst(models, func(_ int, model *dto.ModelInfo) bool {
+		return model.ID == modelID
+	})
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("model `%s` not found", modelID))
+	}
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, newGeminiModel(model), "  "))
+}
+
+// geminiModelAction 处理 models/{model}:{action}，模型ID中可能包含斜杠
+func geminiModelAction(reqCtx echo.Context) error {
+	path := reqCtx.Param("*")
+	idx := strings.LastIndex(path, ":")
+	if idx < 0 {
+		return echo.ErrNotFound
+	}
+	model, action := path[:idx], path[idx+1:]
+	switch action {
+	case "generateContent":
+		return geminiGenerateContent(reqCtx, model, false)
+	case "streamGenerateContent":
+		return geminiGenerateContent(reqCtx, model, true)
+	default:
+		return echo.ErrNotFound
+	}
+}
+
+func geminiGenerateContent(reqCtx echo.Context, model string, stream bool) error {
+	auth, err := newRequestAuth(reqCtx, geminiAuthToken(reqCtx))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	var req geminiGenerateContentRequest
+	if err = stlerr.ErrorWrap(reqCtx.Bind(&req)); err != nil {
+		_ = config.Logger.Error(err)
+		return echo.ErrBadRequest
+	}
+	if len(req.Contents) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "contents must not be empty")
+	}
+
+	var structuredOpts *structuredOutputOptions
+	if req.GenerationConfig.ResponseMimeType == "application/json" {
+		if req.GenerationConfig.ResponseSchema != nil {
+			schema, _ := normalizeGeminiSchema(req.GenerationConfig.ResponseSchema).(map[string]any)
+			structuredOpts = &structuredOutputOptions{Type: openai.ChatCompletionResponseFormatTypeJSONSchema, Name: "response", Schema: schema}
+		} else {
+			structuredOpts = &structuredOutputOptions{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+		}
+	}
+
+	turn, err := resolveChatTurn(reqCtx.Request().Context(), cli, auth, model, req.ChatMessages(), nil, "")
+	if err != nil {
+		return err
+	}
+	params, msgChan, err := turn.Chat(reqCtx.Request().Context(), cli, func(turn *chatTurn) string {
+		return buildChatPrompt(turn.Messages, "", structuredOpts)
+	})
+	if err != nil {
+		return err
+	}
+	if structuredOpts != nil {
+		msgChan, err = generateStructuredOutput(reqCtx.Request().Context(), cli, turn, params, structuredOpts, msgChan)
+		if err != nil {
+			return err
+		}
+	}
+	reader := newChatReader(msgChan, chatReaderOptions{
+		StopSequences: req.GenerationConfig.StopSequences,
+		MaxTokens:     req.GenerationConfig.MaxOutputTokens,
+		ReasoningMode: modelReasoningMode(turn.Model),
+		Tokenizer:     tokenizer.ForModel(turn.Model),
+		Abort:         turn.Abort,
+	})
+
+	newResponse := func(parts []geminiPart, final bool) *geminiGenerateContentResponse {
+		resp := &geminiGenerateContentResponse{
+			Candidates:   []geminiCandidate{{Content: geminiContent{Role: "model", Parts: parts}}},
+			ModelVersion: turn.Model,
+		}
+		if final {
+			resp.Candidates[0].FinishReason = stlval.Ternary(reader.FinishReason == chatFinishReasonLength, "MAX_TOKENS", "STOP")
+			promptTokens := turn.PromptTokens()
+			resp.UsageMetadata = &geminiUsageMetadata{
+				PromptTokenCount:     promptTokens,
+				CandidatesTokenCount: reader.Tokens,
+				TotalTokenCount:      promptTokens + reader.Tokens,
+				ThoughtsTokenCount:   reader.ReasoningTokens(),
+			}
+		}
+		return resp
+	}
+
+	if !stream {
+		if _, err = reader.ReadAll(reqCtx.Request().Context()); err != nil {
+			return err
+		}
+		turn.Save(cli, reader, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reader.Text.String()})
+		var parts []geminiPart
+		if reader.Reasoning.Len() > 0 {
+			parts = append(parts, geminiPart{Text: reader.Reasoning.String(), Thought: true})
+		}
+		parts = append(parts, geminiPart{Text: reader.Text.String()})
+		return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, newResponse(parts, true), "  "))
+	}
+
+	// alt=sse时使用SSE，否则以流式JSON数组返回
+	sse := reqCtx.QueryParam("alt") == "sse"
+	writer := reqCtx.Response()
+	if sse {
+		setSSEHeaders(writer)
+	} else {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Transfer-Encoding", "chunked")
+	}
+	var count int
+	writeResponse := func(resp any) error {
+		defer func() { count++ }()
+		if sse {
+			return writeSSEData(writer, resp)
+		}
+		data, err := stlerr.ErrorWith(json.Marshal(resp))
+		if err != nil {
+			return err
+		}
+		_, err = stlerr.ErrorWith(writer.Write([]byte(stlval.Ternary(count == 0, "[", "\n,") + string(data))))
+		if err != nil {
+			return err
+		}
+		writer.Flush()
+		return nil
+	}
+
+	for {
+		event, err := reader.Next(reqCtx.Request().Context())
+		if err != nil && count > 0 {
+			// 已经开始输出，以错误对象作为最后一个元素告知客户端
+			status, body := newOpenAIError(err)
+			_ = writeResponse(newGeminiErrorResponse(status, body.Message))
+			if !sse {
+				_, _ = writer.Write([]byte("]"))
+				writer.Flush()
+			}
+			return err
+		} else if err != nil {
+			return err
+		} else if event == nil {
+			break
+		}
+
+		switch event.Type {
+		case chatEventText:
+			err = writeResponse(newResponse([]geminiPart{{Text: event.Text}}, false))
+		case chatEventReasoning:
+			err = writeResponse(newResponse([]geminiPart{{Text: event.Text, Thought: true}}, false))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	turn.Save(cli, reader, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reader.Text.String()})
+	if err = writeResponse(newResponse([]geminiPart{{Text: ""}}, true)); err != nil {
+		return err
+	}
+	if !sse {
+		_, err = stlerr.ErrorWith(writer.Write([]byte("]")))
+		writer.Flush()
+	}
+	return err
+}
+
+// normalizeGeminiSchema 将Gemini的OpenAPI风格schema转换为JSON schema
+func normalizeGeminiSchema(schema any) any {
+	switch value := schema.(type) {
+	case map[string]any:
+		res := make(map[string]any, len(value))
+		for k, v := range value {
+			if str, ok := v.(string); ok && k == "type" {
+				res[k] = strings.ToLower(str)
+				continue
+			}
+			res[k] = normalizeGeminiSchema(v)
+		}
+		if nullable, _ := res["nullable"].(bool); nullable {
+			if t, ok := res["type"].(string); ok {
+				res["type"] = []any{t, "null"}
+			}
+		}
+		return res
+	case []any:
+		return stlslices.Map(value, func(_ int, v any) any {
+			return normalizeGeminiSchema(v)
+		})
+	default:
+		return value
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+)
+
+// imageGenerationSystemPrompt 图片生成使用独立的会话，避免影响普通对话
+const imageGenerationSystemPrompt = "You are an image generation assistant. For every request, call the image generation tool exactly once with the given prompt, width and height, then reply briefly."
+
+type imageGenerationRequest struct {
+	Model          string `json:"model,omitempty"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+	Quality        string `json:"quality,omitempty"`
+	Style          string `json:"style,omitempty"`
+}
+
+type imageData struct {
+	URL           string `json:"url,omitempty"`
+	B64JSON       string `json:"b64_json,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+type imageGenerationResponse struct {
+	Created int64        `json:"created"`
+	Data    []*imageData `json:"data"`
+}
+
+// parseImageSize 解析WxH格式的图片尺寸
+func parseImageSize(size string) (int, int, bool) {
+	if size == "" || size == "auto" {
+		return 1024, 1024, true
+	}
+	res := regexp.MustCompile(`^(\d+)x(\d+)$`).FindStringSubmatch(size)
+	if len(res) != 3 {
+		return 0, 0, false
+	}
+	width, _ := strconv.Atoi(res[1])
+	height, _ := strconv.Atoi(res[2])
+	return width, height, width > 0 && height > 0
+}
+
+func imageGenerations(reqCtx echo.Context) error {
+	auth, err := newRequestAuth(reqCtx, strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	var req imageGenerationRequest
+	if err = stlerr.ErrorWrap(reqCtx.Bind(&req)); err != nil {
+		_ = config.Logger.Error(err)
+		return echo.ErrBadRequest
+	}
+	if req.Prompt == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "prompt must not be empty")
+	}
+	req.N = stlval.Ternary(req.N <= 0, 1, req.N)
+	if req.N > config.MaxImages {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("n must be less than or equal to %d", config.MaxImages))
+	}
+	width, height, ok := parseImageSize(req.Size)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "size must be in the format WIDTHxHEIGHT")
+	}
+	switch req.ResponseFormat {
+	case "", "url", "b64_json":
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "response_format must be url or b64_json")
+	}
+
+	// OpenAI的图片模型名无法对应HuggingChat的模型，使用第一个可用模型调用图片生成工具
+	if req.Model == "" || strings.HasPrefix(req.Model, "dall-e") || strings.HasPrefix(req.Model, "gpt-image") {
+		models, err := cli.ListModels(reqCtx.Request().Context())
+		if err != nil {
+			return err
+		}
+		model, ok := stlslices.FindFirst(models, func(_ int, model *dto.ModelInfo) bool {
+			return model.Active
+		})
+		if !ok {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "no available model")
+		}
+		req.Model = model.ID
+	}
+
+	type imageResult struct {
+		index int
+		data  *imageData
+		err   error
+	}
+	ctx, cancel := context.WithCancel(reqCtx.Request().Context())
+	defer cancel()
+	resultChan := make(chan *imageResult, req.N)
+	for i := 0; i < req.N; i++ {
+		go func(index int) {
+			defer func() {
+				if err := recover(); err != nil {
+					_ = config.Logger.Error(err)
+					resultChan <- &imageResult{index: index, err: stlerr.Errorf("%v", err)}
+				}
+			}()
+			data, err := generateImage(ctx, cli, auth, &req, width, height, func(convID string, sha string) (string, error) {
+				return outputURL(reqCtx, auth.Credential, convID, sha), nil
+			})
+			resultChan <- &imageResult{index: index, data: data, err: err}
+		}(i)
+	}
+
+	resp := &imageGenerationResponse{
+		Created: time.Now().Unix(),
+		Data:    make([]*imageData, req.N),
+	}
+	for i := 0; i < req.N; i++ {
+		result := <-resultChan
+		if result.err != nil {
+			return result.err
+		}
+		resp.Data[result.index] = result.data
+	}
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, resp, "  "))
+}
+
+// generateImage 通过HuggingChat的图片生成工具生成一张图片，imageURL用于生成图片的访问地址
+func generateImage(ctx context.Context, cli *hugchat.Client, auth *requestAuth, req *imageGenerationRequest, width int, height int, imageURL func(convID string, sha string) (string, error)) (*imageData, error) {
+	inputs := fmt.Sprintf("Generate an image.\nprompt: %s\nwidth: %d\nheight: %d", req.Prompt, width, height)
+	msgs := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: imageGenerationSystemPrompt},
+		{Role: openai.ChatMessageRoleUser, Content: inputs},
+	}
+	turn, err := resolveChatTurn(ctx, cli, auth, req.Model, msgs, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	turn.Tools = []string{hugchat.ToolImageGeneration}
+	_, msgChan, err := turn.Chat(ctx, cli, func(*chatTurn) string {
+		return inputs
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		go func() {
+			for range msgChan {
+			}
+		}()
+	}()
+
+	revisedPrompt := req.Prompt
+	var sha string
+	for sha == "" {
+		var msg *dto.StreamMessage
+		select {
+		case <-ctx.Done():
+			turn.Abort()
+			return nil, stlerr.Errorf("client disconnected")
+		case msg = <-msgChan:
+		}
+		if msg == nil {
+			break
+		}
+		switch msg.Type {
+		case dto.StreamMessageTypeError:
+			return nil, msg.Error
+		case dto.StreamMessageTypeTool:
+			if msg.Call != nil && msg.Call.Parameters.String("prompt") != "" {
+				revisedPrompt = msg.Call.Parameters.String("prompt")
+			}
+		case dto.StreamMessageTypeFile:
+			if msg.SHA != nil && strings.HasPrefix(stlval.DerefPtrOr(msg.MIME), "image/") {
+				sha = *msg.SHA
+			}
+		}
+		if msg.Type == dto.StreamMessageTypeFinalAnswer {
+			break
+		}
+	}
+	if sha == "" {
+		return nil, echo.NewHTTPError(http.StatusBadGateway, "image generation tool returned no image")
+	}
+
+	if req.ResponseFormat != "b64_json" {
+		url, err := imageURL(turn.ConversationID, sha)
+		if err != nil {
+			return nil, err
+		}
+		return &imageData{
+			URL:           url,
+			RevisedPrompt: revisedPrompt,
+		}, nil
+	}
+	data, _, err := cli.ConversationOutput(ctx, turn.ConversationID, sha)
+	if err != nil {
+		return nil, err
+	}
+	return &imageData{
+		B64JSON:       base64.StdEncoding.EncodeToString(data),
+		RevisedPrompt: revisedPrompt,
+	}, nil
+}
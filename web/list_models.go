@@ -9,18 +9,16 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/sashabaranov/go-openai"
 
-	"github.com/kkkunny/HuggingChatAPI/config"
 	"github.com/kkkunny/HuggingChatAPI/hugchat"
 	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
 )
 
 func listModels(reqCtx echo.Context) error {
-	tokenProvider, err := parseAuthorization(strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "))
+	auth, err := newRequestAuth(reqCtx, strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "))
 	if err != nil {
-		_ = config.Logger.Error(err)
-		return echo.ErrUnauthorized
+		return err
 	}
-	cli := hugchat.NewClient(tokenProvider)
+	cli := hugchat.NewClient(auth.Provider)
 
 	models, err := cli.ListModels(reqCtx.Request().Context())
 	if err != nil {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	"github.com/labstack/echo/v4"
+
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+)
+
+type toolObject struct {
+	ID          string `json:"id"`
+	Object      string `json:"object"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+}
+
+func listTools(reqCtx echo.Context) error {
+	auth, err := newRequestAuth(reqCtx, strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	tools, err := cli.ListTools(reqCtx.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, map[string]any{
+		"object": "list",
+		"data": stlslices.Map(tools, func(_ int, tool *dto.ToolInfo) *toolObject {
+			return &toolObject{
+				ID:          tool.ID,
+				Object:      "tool",
+				Name:        tool.Name,
+				DisplayName: tool.DisplayName,
+				Description: tool.Desc,
+				Type:        tool.Type,
+			}
+		}),
+	}, "  "))
+}
@@ -14,10 +14,30 @@ func main() {
 	svr.Logger.SetLevel(log.OFF)
 	svr.IPExtractor = echo.ExtractIPFromRealIPHeader()
 
-	svr.Use(midErrorHandler, midLogger)
+	svr.Use(midErrorHandler, midLogger, midAccountPool)
 
 	svr.GET("/v1/models", listModels)
+	svr.GET("/v1/tools", listTools)
 	svr.POST("/v1/chat/completions", chatCompletions)
+	svr.POST("/v1/completions", completions)
+	svr.POST("/v1/images/generations", imageGenerations)
+	svr.POST("/v1/files", uploadFile)
+	svr.GET("/v1/files", listFiles)
+	svr.GET("/v1/files/:id", retrieveFile)
+	svr.GET("/v1/files/:id/content", retrieveFileContent)
+	svr.DELETE("/v1/files/:id", deleteFile)
+	svr.GET("/v1/outputs/:conversation/:sha", getOutput)
+	svr.POST("/v1/messages", anthropicMessages)
+	svr.POST("/v1/responses", createResponse)
+	svr.GET("/v1/responses/:id", getResponse)
+
+	svr.GET("/api/tags", ollamaListModels)
+	svr.POST("/api/chat", ollamaChat)
+	svr.POST("/api/generate", ollamaGenerate)
+
+	svr.GET("/v1beta/models", geminiListModels)
+	svr.GET("/v1beta/models/*", geminiGetModel)
+	svr.POST("/v1beta/models/*", geminiModelAction)
 
 	_ = config.Logger.Keywordf("listen http: 0.0.0.0:80")
 	stlerr.Must(svr.Start(":80"))
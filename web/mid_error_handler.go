@@ -2,12 +2,19 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 
 	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
 	"github.com/labstack/echo/v4"
 
 	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/internal/api"
 )
 
 func midErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
@@ -19,12 +26,7 @@ func midErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
 				if !isPanic {
 					_ = config.Logger.Error(err)
 				}
-				var httpErr *echo.HTTPError
-				if errors.As(err, &httpErr) {
-					err = httpErr
-				} else {
-					err = echo.NewHTTPError(http.StatusInternalServerError)
-				}
+				err = newAPIHTTPError(reqCtx, err)
 			}
 		}()
 
@@ -43,3 +45,167 @@ func midErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
 		return next(reqCtx)
 	}
 }
+
+// openAIErrorResponse OpenAI格式的错误响应
+type openAIErrorResponse struct {
+	Error openAIError `json:"error"`
+}
+
+type openAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Code    *string `json:"code"`
+	Param   *string `json:"param"`
+}
+
+// newAPIHTTPError 将错误转换为HTTP错误，响应体使用路由所属API的错误格式，需要时设置Retry-After
+func newAPIHTTPError(reqCtx echo.Context, err error) *echo.HTTPError {
+	status, body := newOpenAIError(err)
+	if apiErr, ok := api.AsError(err); ok && apiErr.RetryAfter > 0 {
+		reqCtx.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apiErr.RetryAfter.Seconds()))))
+	}
+
+	var resp any
+	switch path := reqCtx.Path(); {
+	case path == "/v1/messages":
+		resp = newAnthropicErrorResponse(status, body.Message)
+	case strings.HasPrefix(path, "/api/"):
+		resp = &ollamaErrorResponse{Error: body.Message}
+	case strings.HasPrefix(path, "/v1beta/"):
+		resp = newGeminiErrorResponse(status, body.Message)
+	default:
+		resp = &openAIErrorResponse{Error: body}
+	}
+	return echo.NewHTTPError(status, resp).SetInternal(err)
+}
+
+// newOpenAIError 按错误类型确定状态码和OpenAI格式的错误
+func newOpenAIError(err error) (int, openAIError) {
+	var httpErr *echo.HTTPError
+	if apiErr, ok := api.AsError(err); ok {
+		return openAIErrorFromAPI(apiErr)
+	} else if errors.Is(err, hugchat.RefreshTokenError) {
+		return http.StatusUnauthorized, openAIError{Type: openAIErrorType(http.StatusUnauthorized), Message: "invalid or expired token", Code: stlval.Ptr("invalid_api_key")}
+	} else if errors.As(err, &httpErr) {
+		body := openAIError{Type: openAIErrorType(httpErr.Code), Message: fmt.Sprint(httpErr.Message)}
+		if httpErr.Code == http.StatusUnauthorized {
+			body.Code = stlval.Ptr("invalid_api_key")
+		}
+		return httpErr.Code, body
+	}
+	return http.StatusInternalServerError, openAIError{Type: openAIErrorType(http.StatusInternalServerError), Message: http.StatusText(http.StatusInternalServerError)}
+}
+
+func openAIErrorFromAPI(err *api.Error) (int, openAIError) {
+	body := openAIError{Message: err.Error(), Code: stlval.Ptr(string(err.Kind))}
+	var status int
+	switch err.Kind {
+	case api.ErrorKindUnauthorized:
+		status, body.Code = http.StatusUnauthorized, stlval.Ptr("invalid_api_key")
+	case api.ErrorKindRateLimited:
+		status, body.Code = http.StatusTooManyRequests, stlval.Ptr("rate_limit_exceeded")
+	case api.ErrorKindQuotaExceeded:
+		status, body.Code = http.StatusTooManyRequests, stlval.Ptr("insufficient_quota")
+	case api.ErrorKindModelNotFound:
+		status, body.Param = http.StatusNotFound, stlval.Ptr("model")
+	case api.ErrorKindConversationNotFound:
+		status = http.StatusNotFound
+	case api.ErrorKindInvalidRequest:
+		status = stlval.Ternary(err.StatusCode >= 400 && err.StatusCode < 500, err.StatusCode, http.StatusBadRequest)
+	case api.ErrorKindUpstreamUnavailable:
+		status = http.StatusServiceUnavailable
+	default:
+		status = http.StatusBadGateway
+	}
+	body.Type = openAIErrorType(status)
+	return status, body
+}
+
+// openAIErrorType 按状态码确定OpenAI的错误类型
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 500:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// anthropicErrorResponse Anthropic格式的错误响应
+type anthropicErrorResponse struct {
+	Type  string         `json:"type"`
+	Error anthropicError `json:"error"`
+}
+
+type anthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func newAnthropicErrorResponse(status int, message string) *anthropicErrorResponse {
+	var errType string
+	switch {
+	case status == http.StatusUnauthorized:
+		errType = "authentication_error"
+	case status == http.StatusForbidden:
+		errType = "permission_error"
+	case status == http.StatusNotFound:
+		errType = "not_found_error"
+	case status == http.StatusRequestEntityTooLarge:
+		errType = "request_too_large"
+	case status == http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case status == http.StatusServiceUnavailable:
+		errType = "overloaded_error"
+	case status >= 500:
+		errType = "api_error"
+	default:
+		errType = "invalid_request_error"
+	}
+	return &anthropicErrorResponse{Type: "error", Error: anthropicError{Type: errType, Message: message}}
+}
+
+// ollamaErrorResponse Ollama格式的错误响应
+type ollamaErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// geminiErrorResponse Gemini格式的错误响应
+type geminiErrorResponse struct {
+	Error geminiError `json:"error"`
+}
+
+type geminiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func newGeminiErrorResponse(status int, message string) *geminiErrorResponse {
+	var errStatus string
+	switch {
+	case status == http.StatusUnauthorized:
+		errStatus = "UNAUTHENTICATED"
+	case status == http.StatusForbidden:
+		errStatus = "PERMISSION_DENIED"
+	case status == http.StatusNotFound:
+		errStatus = "NOT_FOUND"
+	case status == http.StatusTooManyRequests:
+		errStatus = "RESOURCE_EXHAUSTED"
+	case status == http.StatusServiceUnavailable:
+		errStatus = "UNAVAILABLE"
+	case status == http.StatusGatewayTimeout:
+		errStatus = "DEADLINE_EXCEEDED"
+	case status >= 500:
+		errStatus = "INTERNAL"
+	default:
+		errStatus = "INVALID_ARGUMENT"
+	}
+	return &geminiErrorResponse{Error: geminiError{Code: status, Message: message, Status: errStatus}}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+type ollamaModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type ollamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt time.Time          `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    ollamaModelDetails `json:"details"`
+}
+
+type ollamaOptions struct {
+	Stop        []string `json:"stop,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role     string   `json:"role"`
+	Content  string   `json:"content"`
+	Thinking string   `json:"thinking,omitempty"`
+	Images   []string `json:"images,omitempty"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream,omitempty"`
+	Format   json.RawMessage `json:"format,omitempty"`
+	Options  ollamaOptions   `json:"options,omitempty"`
+}
+
+type ollamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	System  string          `json:"system,omitempty"`
+	Stream  *bool           `json:"stream,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options ollamaOptions   `json:"options,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+}
+
+// ollamaResponse 同时用于/api/chat和/api/generate的响应
+type ollamaResponse struct {
+	Model              string         `json:"model"`
+	CreatedAt          time.Time      `json:"created_at"`
+	Message            *ollamaMessage `json:"message,omitempty"`
+	Response           *string        `json:"response,omitempty"`
+	Thinking           string         `json:"thinking,omitempty"`
+	Done               bool           `json:"done"`
+	DoneReason         string         `json:"done_reason,omitempty"`
+	TotalDuration      int64          `json:"total_duration,omitempty"`
+	LoadDuration       int64          `json:"load_duration,omitempty"`
+	PromptEvalCount    int            `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64          `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int            `json:"eval_count,omitempty"`
+	EvalDuration       int64          `json:"eval_duration,omitempty"`
+}
+
+// ollamaAuthToken 请求携带的凭证，没有Authorization请求头时使用OLLAMA_AUTHORIZATION
+func ollamaAuthToken(reqCtx echo.Context) string {
+	if token := strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "); token != "" {
+		return token
+	}
+	return config.OllamaAuthorization
+}
+
+func ollamaListModels(reqCtx echo.Context) error {
+	auth, err := newRequestAuth(reqCtx, ollamaAuthToken(reqCtx))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	models, err := cli.ListModels(reqCtx.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, map[string]any{
+		"models": stlslices.Map(stlslices.Filter(models, func(_ int, model *dto.ModelInfo) bool {
+			return model.Active
+		}), func(_ int, model *dto.ModelInfo) *ollamaModel {
+			return &ollamaModel{
+				Name:       model.ID,
+				Model:      model.ID,
+				ModifiedAt: time.Unix(1692901427, 0),
+				Details: ollamaModelDetails{
+					Format:   "huggingchat",
+					Families: []string{},
+				},
+			}
+		}),
+	}, "  "))
+}
+
+func ollamaChat(reqCtx echo.Context) error {
+	var req ollamaChatRequest
+	if err := stlerr.ErrorWrap(reqCtx.Bind(&req)); err != nil {
+		_ = config.Logger.Error(err)
+		return echo.ErrBadRequest
+	}
+	if len(req.Messages) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "messages must not be empty")
+	}
+	msgs := stlslices.Map(req.Messages, func(_ int, msg ollamaMessage) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: msg.Role, Content: msg.Content}
+	})
+	return ollamaGenerateReply(reqCtx, req.Model, msgs, stlval.DerefPtrOr(req.Stream, true), req.Format, req.Options, true)
+}
+
+func ollamaGenerate(reqCtx echo.Context) error {
+	var req ollamaGenerateRequest
+	if err := stlerr.ErrorWrap(reqCtx.Bind(&req)); err != nil {
+		_ = config.Logger.Error(err)
+		return echo.ErrBadRequest
+	}
+	if req.Prompt == "" {
+		// 空的prompt用于预加载模型
+		return stlerr.ErrorWrap(reqCtx.JSON(http.StatusOK, &ollamaResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Response:   stlval.Ptr(""),
+			Done:       true,
+			DoneReason: "load",
+		}))
+	}
+	var msgs []openai.ChatCompletionMessage
+	if req.System != "" {
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: req.System})
+	}
+	msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: req.Prompt})
+	return ollamaGenerateReply(reqCtx, req.Model, msgs, stlval.DerefPtrOr(req.Stream, true), req.Format, req.Options, false)
+}
+
+// ollamaGenerateReply 生成回复，isChat决定返回/api/chat还是/api/generate格式
+func ollamaGenerateReply(reqCtx echo.Context, model string, msgs []openai.ChatCompletionMessage, stream bool, format json.RawMessage, opts ollamaOptions, isChat bool) error {
+	auth, err := newRequestAuth(reqCtx, ollamaAuthToken(reqCtx))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+	startAt := time.Now()
+
+	var structuredOpts *structuredOutputOptions
+	if len(format) > 0 && string(format) != "null" && string(format) != `""` {
+		if string(format) == `"json"` {
+			structuredOpts = &structuredOutputOptions{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+		} else {
+			var schema map[string]any
+			if err = json.Unmarshal(format, &schema); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "format must be \"json\" or a JSON schema")
+			}
+			structuredOpts = &structuredOutputOptions{Type: openai.ChatCompletionResponseFormatTypeJSONSchema, Name: "format", Schema: schema}
+		}
+	}
+
+	turn, err := resolveChatTurn(reqCtx.Request().Context(), cli, auth, model, msgs, nil, "")
+	if err != nil {
+		return err
+	}
+	params, msgChan, err := turn.Chat(reqCtx.Request().Context(), cli, func(turn *chatTurn) string {
+		return buildChatPrompt(turn.Messages, "", structuredOpts)
+	})
+	if err != nil {
+		return err
+	}
+	if structuredOpts != nil {
+		msgChan, err = generateStructuredOutput(reqCtx.Request().Context(), cli, turn, params, structuredOpts, msgChan)
+		if err != nil {
+			return err
+		}
+	}
+	reader := newChatReader(msgChan, chatReaderOptions{
+		StopSequences: opts.Stop,
+		MaxTokens:     opts.NumPredict,
+		ReasoningMode: modelReasoningMode(turn.Model),
+		Tokenizer:     tokenizer.ForModel(turn.Model),
+		Abort:         turn.Abort,
+	})
+
+	newResponse := func(text string, thinking string) *ollamaResponse {
+		resp := &ollamaResponse{Model: turn.Model, CreatedAt: time.Now().UTC()}
+		if isChat {
+			resp.Message = &ollamaMessage{Role: openai.ChatMessageRoleAssistant, Content: text, Thinking: thinking}
+		} else {
+			resp.Response, resp.Thinking = &text, thinking
+		}
+		return resp
+	}
+	finalResponse := func(resp *ollamaResponse) *ollamaResponse {
+		duration := time.Since(startAt).Nanoseconds()
+		resp.Done = true
+		resp.DoneReason = stlval.Ternary(reader.FinishReason == chatFinishReasonLength, "length", "stop")
+		resp.TotalDuration = duration
+		resp.PromptEvalCount = turn.PromptTokens()
+		resp.EvalCount = reader.Tokens
+		resp.EvalDuration = duration
+		return resp
+	}
+
+	if !stream {
+		if _, err = reader.ReadAll(reqCtx.Request().Context()); err != nil {
+			return err
+		}
+		turn.Save(cli, reader, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reader.Text.String()})
+		return stlerr.ErrorWrap(reqCtx.JSON(http.StatusOK, finalResponse(newResponse(reader.Text.String(), reader.Reasoning.String()))))
+	}
+
+	writer := reqCtx.Response()
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Transfer-Encoding", "chunked")
+	for {
+		event, err := reader.Next(reqCtx.Request().Context())
+		if err != nil {
+			// 已经开始输出，只能通过error行告知客户端，错误仍然返回以便账号池记录
+			_, body := newOpenAIError(err)
+			_ = writeNDJSON(writer, &ollamaErrorResponse{Error: body.Message})
+			return err
+		} else if event == nil {
+			break
+		}
+
+		switch event.Type {
+		case chatEventText:
+			err = writeNDJSON(writer, newResponse(event.Text, ""))
+		case chatEventReasoning:
+			err = writeNDJSON(writer, newResponse("", event.Text))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	turn.Save(cli, reader, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reader.Text.String()})
+	return writeNDJSON(writer, finalResponse(newResponse("", "")))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	stlerr "github.com/kkkunny/stl/error"
+	"github.com/labstack/echo/v4"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+)
+
+const outputURLExpiration = 24 * time.Hour
+
+var outputKeyPath = filepath.Join(config.DataDir, "output.key")
+
+type fileOutputFormat string
+
+const (
+	fileOutputFormatURL    fileOutputFormat = "url"    // 返回带签名的代理地址
+	fileOutputFormatBase64 fileOutputFormat = "base64" // 以base64 data URL内联返回
+)
+
+// outputKey 签名代理地址的HMAC密钥，取自OUTPUT_SIGNING_KEY环境变量，未设置时随机生成并保存到outputKeyPath
+var outputKey []byte
+
+func init() {
+	outputKey = stlerr.MustWith(loadOutputKey())
+}
+
+func loadOutputKey() ([]byte, error) {
+	if config.OutputSigningKey != "" {
+		key := sha256.Sum256([]byte(config.OutputSigningKey))
+		return key[:], nil
+	}
+
+	key, err := stlerr.ErrorWith(os.ReadFile(outputKeyPath))
+	if err == nil && len(key) == 32 {
+		return key, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err = stlerr.ErrorWith(rand.Read(key)); err != nil {
+		return nil, err
+	}
+	if err = stlerr.ErrorWrap(os.MkdirAll(filepath.Dir(outputKeyPath), 0750)); err != nil {
+		return nil, err
+	}
+	return key, stlerr.ErrorWrap(os.WriteFile(outputKeyPath, key, 0600))
+}
+
+// outputCredentials 签发过代理地址的凭证，只保存在内存中，地址中只包含凭证摘要
+var outputCredentials = &outputCredentialStore{data: make(map[string]*outputCredential)}
+
+type outputCredential struct {
+	credential string
+	until      time.Time
+}
+
+type outputCredentialStore struct {
+	lock sync.Mutex
+	data map[string]*outputCredential
+}
+
+// Add 记录凭证直到until，返回凭证摘要
+func (store *outputCredentialStore) Add(credential string, until time.Time) string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	for key, value := range store.data {
+		if now.After(value.until) {
+			delete(store.data, key)
+		}
+	}
+	account := hashString(credential)
+	if exist, ok := store.data[account]; !ok || exist.until.Before(until) {
+		store.data[account] = &outputCredential{credential: credential, until: until}
+	}
+	return account
+}
+
+// Get 按凭证摘要查找凭证，账号池中的账号总是可以找到
+func (store *outputCredentialStore) Get(account string) (string, bool) {
+	if credential, ok := globalAccountPool.CredentialByHash(account); ok {
+		return credential, true
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	value, ok := store.data[account]
+	if !ok || time.Now().After(value.until) {
+		return "", false
+	}
+	return value.credential, true
+}
+
+func outputSignature(convID string, sha string, account string, expires int64) string {
+	mac := hmac.New(sha256.New, outputKey)
+	mac.Write([]byte(strings.Join([]string{convID, sha, account, strconv.FormatInt(expires, 10)}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// outputURL 生成会话输出文件的签名代理地址，credential为会话所属账号的凭证，地址中只包含其摘要，24小时内有效
+func outputURL(reqCtx echo.Context, credential string, convID string, sha string) string {
+	expiresAt := time.Now().Add(outputURLExpiration)
+	account := outputCredentials.Add(credential, expiresAt)
+
+	query := url.Values{}
+	query.Set("account", account)
+	query.Set("exp", strconv.FormatInt(expiresAt.Unix(), 10))
+	query.Set("sig", outputSignature(convID, sha, account, expiresAt.Unix()))
+	return fmt.Sprintf("%s://%s/v1/outputs/%s/%s?%s", reqCtx.Scheme(), reqCtx.Request().Host, url.PathEscape(convID), url.PathEscape(sha), query.Encode())
+}
+
+// outputDataURL 下载会话输出文件并转换为data URL
+func outputDataURL(ctx context.Context, cli *hugchat.Client, convID string, sha string, mimeType string) (string, error) {
+	data, respMime, err := cli.ConversationOutput(ctx, convID, sha)
+	if err != nil {
+		return "", err
+	}
+	if mimeType == "" {
+		mimeType = respMime
+	}
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// fileOutputURL 按输出格式生成会话输出文件的地址
+func fileOutputURL(reqCtx echo.Context, cli *hugchat.Client, credential string, format fileOutputFormat, convID string, sha string, mimeType string) (string, error) {
+	if format == fileOutputFormatBase64 {
+		return outputDataURL(reqCtx.Request().Context(), cli, convID, sha, mimeType)
+	}
+	return outputURL(reqCtx, credential, convID, sha), nil
+}
+
+// getOutput 校验签名后使用会话所属账号获取输出文件，服务重启后非账号池账号的地址需要请求携带该账号的Authorization
+func getOutput(reqCtx echo.Context) error {
+	convID, sha, account := reqCtx.Param("conversation"), reqCtx.Param("sha"), reqCtx.QueryParam("account")
+	expires, err := strconv.ParseInt(reqCtx.QueryParam("exp"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(reqCtx.QueryParam("sig")), []byte(outputSignature(convID, sha, account, expires))) {
+		return echo.NewHTTPError(http.StatusForbidden, "invalid signature")
+	} else if time.Now().Unix() > expires {
+		return echo.NewHTTPError(http.StatusForbidden, "url expired")
+	}
+
+	credential, ok := outputCredentials.Get(account)
+	if token := strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "); !ok && token != "" && hashString(token) == account {
+		credential, ok = token, true
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "account of the output is unavailable")
+	}
+	provider, err := parseAuthorization(credential)
+	if err != nil {
+		return err
+	}
+
+	data, mimeType, err := hugchat.NewClient(provider).ConversationOutput(reqCtx.Request().Context(), convID, sha)
+	if err != nil {
+		return err
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	reqCtx.Response().Header().Set("Cache-Control", "private, max-age=86400")
+	return stlerr.ErrorWrap(reqCtx.Blob(http.StatusOK, mimeType, data))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	stlerr "github.com/kkkunny/stl/error"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+)
+
+var pdfStreamRegexp = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+
+// maxPDFDecodedSize 所有内容流解压后的总大小上限，防止压缩炸弹；内容流中大部分是排版操作符，因此远大于内联文本的上限
+const maxPDFDecodedSize = 100 * maxInlineDocumentLength
+
+// extractPDFText 提取PDF中的文本，只支持未加密、使用标准编码字体的PDF
+func extractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", stlerr.Errorf("invalid pdf file")
+	} else if bytes.Contains(data, []byte("/Encrypt")) {
+		return "", stlerr.Errorf("encrypted pdf is not supported")
+	}
+
+	var out strings.Builder
+	budget := int64(maxPDFDecodedSize)
+	for _, loc := range pdfStreamRegexp.FindAllSubmatchIndex(data, -1) {
+		// 超出内联上限的文本会被截断，不需要继续提取
+		if out.Len() > maxInlineDocumentLength*utf8.UTFMax {
+			break
+		}
+		dict := data[loc[2]:loc[3]]
+		end := bytes.Index(data[loc[1]:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/XRef")) {
+			continue
+		}
+
+		content := data[loc[1] : loc[1]+end]
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			reader, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			// 流末尾可能有多余的换行，解压出错时保留已解压的部分
+			content, _ = io.ReadAll(io.LimitReader(reader, budget+1))
+			_ = reader.Close()
+			if budget -= int64(len(content)); budget < 0 {
+				_ = config.Logger.Warnf("decoded pdf content exceeds %d bytes, stop extracting", maxPDFDecodedSize)
+				break
+			}
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+		if bytes.Contains(content, []byte("BT")) {
+			extractPDFContentText(content, &out)
+		}
+	}
+
+	text := strings.TrimSpace(regexp.MustCompile(`\n{3,}`).ReplaceAllString(out.String(), "\n\n"))
+	if text == "" {
+		return "", stlerr.Errorf("no extractable text in pdf")
+	}
+	return text, nil
+}
+
+// extractPDFContentText 解释内容流中的文本操作符
+func extractPDFContentText(content []byte, out *strings.Builder) {
+	var inText bool
+	var texts []string
+	var nums []float64
+	newline := func() {
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteByte('\n')
+		}
+	}
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			text, n := readPDFLiteralString(content[i:])
+			texts = append(texts, text)
+			i += n
+		case c == '<' && i+1 < len(content) && content[i+1] == '<':
+			i += 2
+		case c == '<':
+			text, n := readPDFHexString(content[i:])
+			texts = append(texts, text)
+			i += n
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case isPDFDelimiter(c) || isPDFSpace(c):
+			i++
+		default:
+			start := i
+			for i < len(content) && !isPDFDelimiter(content[i]) && !isPDFSpace(content[i]) {
+				i++
+			}
+			token := string(content[start:i])
+			if num, err := strconv.ParseFloat(token, 64); err == nil {
+				nums = append(nums, num)
+				continue
+			}
+
+			switch token {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				newline()
+			case "Td", "TD":
+				if inText && len(nums) >= 2 && nums[len(nums)-1] != 0 {
+					newline()
+				} else if inText && out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+					out.WriteByte(' ')
+				}
+			case "T*":
+				if inText {
+					newline()
+				}
+			case "Tj", "TJ":
+				if inText {
+					out.WriteString(strings.Join(texts, ""))
+				}
+			case "'", "\"":
+				if inText {
+					newline()
+					out.WriteString(strings.Join(texts, ""))
+				}
+			}
+			texts, nums = nil, nil
+		}
+	}
+}
+
+func readPDFLiteralString(data []byte) (string, int) {
+	var buf []byte
+	depth := 0
+	i := 0
+	for ; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data):
+			i++
+			switch e := data[i]; e {
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				if e == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+					i++
+				}
+			default:
+				if e >= '0' && e <= '7' {
+					j := i
+					for j < len(data) && j < i+3 && data[j] >= '0' && data[j] <= '7' {
+						j++
+					}
+					code, _ := strconv.ParseUint(string(data[i:j]), 8, 8)
+					buf = append(buf, byte(code))
+					i = j - 1
+				} else {
+					buf = append(buf, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				buf = append(buf, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return pdfBytesToText(buf), i + 1
+			}
+			buf = append(buf, c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return pdfBytesToText(buf), i
+}
+
+func readPDFHexString(data []byte) (string, int) {
+	end := bytes.IndexByte(data, '>')
+	if end < 0 {
+		return "", len(data)
+	}
+	hex := make([]byte, 0, end)
+	for _, c := range data[1:end] {
+		if !isPDFSpace(c) {
+			hex = append(hex, c)
+		}
+	}
+	if len(hex)%2 != 0 {
+		hex = append(hex, '0')
+	}
+	buf := make([]byte, 0, len(hex)/2)
+	for i := 0; i < len(hex); i += 2 {
+		b, err := strconv.ParseUint(string(hex[i:i+2]), 16, 8)
+		if err != nil {
+			return "", end + 1
+		}
+		buf = append(buf, byte(b))
+	}
+	return pdfBytesToText(buf), end + 1
+}
+
+// pdfBytesToText 按单字节编码转换文本，丢弃控制字符
+func pdfBytesToText(data []byte) string {
+	var builder strings.Builder
+	for _, b := range data {
+		if b >= 0x20 || b == '\n' || b == '\t' {
+			builder.WriteRune(rune(b))
+		}
+	}
+	return builder.String()
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
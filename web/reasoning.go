@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+type reasoningMode string
+
+const (
+	reasoningModeSeparate reasoningMode = "separate" // 通过reasoning_content等字段单独输出
+	reasoningModeInline   reasoningMode = "inline"   // 用think标签包裹后输出到正文
+	reasoningModeHidden   reasoningMode = "hidden"   // 不输出
+)
+
+func (mode reasoningMode) Valid() bool {
+	switch mode {
+	case reasoningModeSeparate, reasoningModeInline, reasoningModeHidden:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolveReasoningMode 确定推理内容的输出方式，优先级为请求、模型配置、默认配置
+func resolveReasoningMode(reqMode reasoningMode, model string) (reasoningMode, error) {
+	if reqMode != "" {
+		if !reqMode.Valid() {
+			return "", echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reasoning_mode must be one of %s, %s or %s", reasoningModeSeparate, reasoningModeInline, reasoningModeHidden))
+		}
+		return reqMode, nil
+	}
+	return modelReasoningMode(model), nil
+}
+
+// modelReasoningMode 模型配置的推理内容输出方式
+func modelReasoningMode(model string) reasoningMode {
+	for _, mode := range []string{config.ModelReasoningModes[model], config.ReasoningMode} {
+		if mode == "" {
+			continue
+		} else if reasoningMode(mode).Valid() {
+			return reasoningMode(mode)
+		}
+		_ = config.Logger.Warnf("unknown reasoning mode `%s`", mode)
+	}
+	return reasoningModeSeparate
+}
+
+var thinkBlockRegexp = regexp.MustCompile(`(?s)<think>.*?</think>\s*`)
+
+// stripThinkBlocks 删除文本中think标签包裹的推理内容
+func stripThinkBlocks(text string) string {
+	return thinkBlockRegexp.ReplaceAllString(text, "")
+}
+
+// thinkSegment 按think标签切分出的文本片段
+type thinkSegment struct {
+	Reasoning bool
+	Text      string
+}
+
+// thinkTagParser 从流式文本中分离think标签包裹的推理内容，可能构成标签前缀的文本会被暂扣
+type thinkTagParser struct {
+	inThink   bool
+	trimSpace bool
+	pending   string
+}
+
+func (p *thinkTagParser) Feed(text string) []thinkSegment {
+	p.pending += text
+
+	var segments []thinkSegment
+	for {
+		tag := thinkOpenTag
+		if p.inThink {
+			tag = thinkCloseTag
+		}
+		if idx := strings.Index(p.pending, tag); idx >= 0 {
+			segments = p.appendSegment(segments, p.pending[:idx])
+			p.pending = p.pending[idx+len(tag):]
+			p.inThink = !p.inThink
+			// 推理内容之后通常跟着空行，不计入正文
+			p.trimSpace = !p.inThink
+			continue
+		}
+
+		keep := 0
+		for i := min(len(tag)-1, len(p.pending)); i > 0; i-- {
+			if strings.HasSuffix(p.pending, tag[:i]) {
+				keep = i
+				break
+			}
+		}
+		segments = p.appendSegment(segments, p.pending[:len(p.pending)-keep])
+		p.pending = p.pending[len(p.pending)-keep:]
+		return segments
+	}
+}
+
+// Flush 返回暂扣的文本
+func (p *thinkTagParser) Flush() []thinkSegment {
+	text := p.pending
+	p.pending = ""
+	return p.appendSegment(nil, text)
+}
+
+func (p *thinkTagParser) appendSegment(segments []thinkSegment, text string) []thinkSegment {
+	if p.trimSpace && !p.inThink {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		p.trimSpace = text == ""
+	}
+	if text == "" {
+		return segments
+	}
+	return append(segments, thinkSegment{Reasoning: p.inThink, Text: text})
+}
+
+// reasoningOutput 经过推理管线处理后的输出
+type reasoningOutput struct {
+	Content   string
+	Reasoning string
+}
+
+// reasoningPipeline 合并HuggingChat单独返回的推理内容和正文中think标签包裹的推理内容，按输出方式转换
+type reasoningPipeline struct {
+	mode       reasoningMode
+	tokenizer  tokenizer.Tokenizer
+	parser     thinkTagParser
+	inlineOpen bool
+
+	Tokens int // 推理内容的token数
+}
+
+func newReasoningPipeline(mode reasoningMode, tok tokenizer.Tokenizer) *reasoningPipeline {
+	if mode == "" {
+		mode = reasoningModeSeparate
+	}
+	return &reasoningPipeline{mode: mode, tokenizer: tok}
+}
+
+// Reasoning 处理HuggingChat返回的推理内容
+func (p *reasoningPipeline) Reasoning(token string) reasoningOutput {
+	var out reasoningOutput
+	if token != "" {
+		p.write(&out, thinkSegment{Reasoning: true, Text: token})
+	}
+	return out
+}
+
+// Stream 处理正文，分离其中的think标签
+func (p *reasoningPipeline) Stream(token string) reasoningOutput {
+	var out reasoningOutput
+	for _, segment := range p.parser.Feed(token) {
+		p.write(&out, segment)
+	}
+	return out
+}
+
+// Flush 返回剩余的输出，inline方式下补全未闭合的think标签
+func (p *reasoningPipeline) Flush() reasoningOutput {
+	var out reasoningOutput
+	for _, segment := range p.parser.Flush() {
+		p.write(&out, segment)
+	}
+	if p.inlineOpen {
+		out.Content += thinkCloseTag + "\n\n"
+		p.inlineOpen = false
+	}
+	return out
+}
+
+func (p *reasoningPipeline) write(out *reasoningOutput, segment thinkSegment) {
+	if !segment.Reasoning {
+		if p.inlineOpen {
+			out.Content += thinkCloseTag + "\n\n"
+			p.inlineOpen = false
+		}
+		out.Content += segment.Text
+		return
+	}
+
+	p.Tokens += tokenizer.Count(p.tokenizer, segment.Text)
+	switch p.mode {
+	case reasoningModeSeparate:
+		out.Reasoning += segment.Text
+	case reasoningModeInline:
+		if !p.inlineOpen {
+			out.Content += thinkOpenTag
+			p.inlineOpen = true
+		}
+		out.Content += segment.Text
+	case reasoningModeHidden:
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+// responsesContent 输入消息内容，可以是字符串或内容列表
+type responsesContent []responsesInputPart
+
+func (c *responsesContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if json.Unmarshal(data, &text) == nil {
+		*c = responsesContent{{Type: "input_text", Text: text}}
+		return nil
+	}
+	var parts []responsesInputPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*c = parts
+	return nil
+}
+
+// Text 拼接内容中的文本
+func (c responsesContent) Text() string {
+	texts := stlslices.Map(stlslices.Filter(c, func(_ int, part responsesInputPart) bool {
+		return part.Type == "input_text" || part.Type == "output_text" || part.Type == "text"
+	}), func(_ int, part responsesInputPart) string {
+		return part.Text
+	})
+	return strings.Join(texts, "\n")
+}
+
+type responsesInputPart struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+}
+
+type responsesInputItem struct {
+	Type    string           `json:"type,omitempty"`
+	Role    string           `json:"role,omitempty"`
+	Content responsesContent `json:"content,omitempty"`
+}
+
+// responsesInput 输入，可以是字符串或输入项列表
+type responsesInput []responsesInputItem
+
+func (input *responsesInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if json.Unmarshal(data, &text) == nil {
+		*input = responsesInput{{Type: "message", Role: openai.ChatMessageRoleUser, Content: responsesContent{{Type: "input_text", Text: text}}}}
+		return nil
+	}
+	var items []responsesInputItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	*input = items
+	return nil
+}
+
+type responsesTextFormat struct {
+	Type        openai.ChatCompletionResponseFormatType `json:"type"`
+	Name        string                                  `json:"name,omitempty"`
+	Description string                                  `json:"description,omitempty"`
+	Schema      json.RawMessage                         `json:"schema,omitempty"`
+	Strict      bool                                    `json:"strict,omitempty"`
+}
+
+type responsesTextOptions struct {
+	Format *responsesTextFormat `json:"format,omitempty"`
+}
+
+type responsesRequest struct {
+	Model              string                `json:"model"`
+	Input              responsesInput        `json:"input"`
+	Instructions       string                `json:"instructions,omitempty"`
+	PreviousResponseID string                `json:"previous_response_id,omitempty"`
+	Stream             bool                  `json:"stream,omitempty"`
+	Store              *bool                 `json:"store,omitempty"`
+	MaxOutputTokens    int                   `json:"max_output_tokens,omitempty"`
+	Text               *responsesTextOptions `json:"text,omitempty"`
+	Temperature        *float64              `json:"temperature,omitempty"`
+	TopP               *float64              `json:"top_p,omitempty"`
+	Metadata           map[string]string     `json:"metadata,omitempty"`
+}
+
+// ChatMessages 转换为OpenAI格式的消息历史
+func (req *responsesRequest) ChatMessages() []openai.ChatCompletionMessage {
+	msgs := make([]openai.ChatCompletionMessage, 0, len(req.Input)+1)
+	if req.Instructions != "" {
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: req.Instructions})
+	}
+	for _, item := range req.Input {
+		if (item.Type != "" && item.Type != "message") || item.Role == "" {
+			continue
+		}
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: item.Role, Content: item.Content.Text()})
+	}
+	return msgs
+}
+
+// StructuredOutputOptions 转换text.format为结构化输出参数
+func (req *responsesRequest) StructuredOutputOptions() (*structuredOutputOptions, error) {
+	if req.Text == nil || req.Text.Format == nil {
+		return nil, nil
+	}
+	format := req.Text.Format
+	return newStructuredOutputOptions(&responseFormat{
+		Type: format.Type,
+		JSONSchema: &responseFormatJSONSchema{
+			Name:        format.Name,
+			Description: format.Description,
+			Schema:      format.Schema,
+			Strict:      format.Strict,
+		},
+	})
+}
+
+type responsesOutputContent struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type responsesSummaryText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type responsesOutputItem struct {
+	Type    string                    `json:"type"`
+	ID      string                    `json:"id"`
+	Status  string                    `json:"status,omitempty"`
+	Role    string                    `json:"role,omitempty"`
+	Content []*responsesOutputContent `json:"content,omitempty"`
+	Summary []*responsesSummaryText   `json:"summary,omitempty"`
+}
+
+type responsesIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type responsesUsage struct {
+	InputTokens         int                       `json:"input_tokens"`
+	OutputTokens        int                       `json:"output_tokens"`
+	OutputTokensDetails responsesOutputTokensInfo `json:"output_tokens_details"`
+	TotalTokens         int                       `json:"total_tokens"`
+}
+
+type responsesOutputTokensInfo struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+type responsesObject struct {
+	ID                 string                      `json:"id"`
+	Object             string                      `json:"object"`
+	CreatedAt          int64                       `json:"created_at"`
+	Status             string                      `json:"status"`
+	Model              string                      `json:"model"`
+	Output             []*responsesOutputItem      `json:"output"`
+	Instructions       *string                     `json:"instructions"`
+	PreviousResponseID *string                     `json:"previous_response_id"`
+	MaxOutputTokens    *int                        `json:"max_output_tokens"`
+	IncompleteDetails  *responsesIncompleteDetails `json:"incomplete_details"`
+	Error              any                         `json:"error"`
+	Store              bool                        `json:"store"`
+	Temperature        *float64                    `json:"temperature,omitempty"`
+	TopP               *float64                    `json:"top_p,omitempty"`
+	Metadata           map[string]string           `json:"metadata"`
+	Usage              *responsesUsage             `json:"usage"`
+}
+
+// responsesContext 一次Responses API请求的上下文
+type responsesContext struct {
+	cli    *hugchat.Client
+	req    *responsesRequest
+	turn   *chatTurn
+	owner  string
+	resp   *responsesObject
+	reader *chatReader
+	// historyTokens previous_response_id接续的历史对话的token数，本轮发送的消息不包含这部分历史
+	historyTokens int
+}
+
+func createResponse(reqCtx echo.Context) error {
+	auth, err := newRequestAuth(reqCtx, strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		return err
+	}
+	cli := hugchat.NewClient(auth.Provider)
+
+	var req responsesRequest
+	if err = stlerr.ErrorWrap(reqCtx.Bind(&req)); err != nil {
+		_ = config.Logger.Error(err)
+		return echo.ErrBadRequest
+	}
+	msgs := req.ChatMessages()
+	if len(nonSystemMessages(msgs)) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "input must not be empty")
+	}
+	structuredOpts, err := req.StructuredOutputOptions()
+	if err != nil {
+		return err
+	}
+
+	var turn *chatTurn
+	var historyTokens int
+	if req.PreviousResponseID != "" {
+		prev, ok := globalResponseStore.Get(req.PreviousResponseID)
+		if !ok || prev.Owner != hashString(auth.Token) {
+			return echo.NewHTTPError(http.StatusNotFound, "previous response not found")
+		} else if prev.MessageID == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "previous response was truncated and cannot be continued")
+		}
+		// 会话只存在于创建它的账号中
+		if auth, err = auth.Pin(reqCtx, prev.Account); err != nil {
+			return err
+		}
+		cli = hugchat.NewClient(auth.Provider)
+		turn = newChatTurnAt(auth, stlval.Ternary(req.Model != "", req.Model, prev.Response.Model), prev.ConversationID, prev.MessageID, msgs)
+		turn.SystemPrompt = prev.SystemPrompt
+		if prev.Response.Usage != nil {
+			historyTokens = prev.Response.Usage.TotalTokens
+		}
+		// 会话的系统提示词无法修改，新的instructions作为系统消息发送
+		if req.Instructions != "" && req.Instructions != prev.SystemPrompt {
+			turn.Messages = append([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: req.Instructions}}, turn.Messages...)
+		}
+	} else {
+		turn, err = resolveChatTurn(reqCtx.Request().Context(), cli, auth, req.Model, msgs, nil, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	params, msgChan, err := turn.Chat(reqCtx.Request().Context(), cli, func(turn *chatTurn) string {
+		return buildChatPrompt(turn.Messages, "", structuredOpts)
+	})
+	if err != nil {
+		return err
+	}
+	if structuredOpts != nil {
+		msgChan, err = generateStructuredOutput(reqCtx.Request().Context(), cli, turn, params, structuredOpts, msgChan)
+		if err != nil {
+			return err
+		}
+	}
+
+	respCtx := &responsesContext{
+		cli:           cli,
+		req:           &req,
+		turn:          turn,
+		owner:         hashString(auth.Token),
+		historyTokens: historyTokens,
+		resp: &responsesObject{
+			ID:                 newRandomID("resp_"),
+			Object:             "response",
+			CreatedAt:          time.Now().Unix(),
+			Status:             "in_progress",
+			Model:              turn.Model,
+			Output:             []*responsesOutputItem{},
+			Instructions:       stlval.Ternary(req.Instructions != "", &req.Instructions, nil),
+			PreviousResponseID: stlval.Ternary(req.PreviousResponseID != "", &req.PreviousResponseID, nil),
+			MaxOutputTokens:    stlval.Ternary(req.MaxOutputTokens > 0, &req.MaxOutputTokens, nil),
+			Store:              stlval.DerefPtrOr(req.Store, true),
+			Temperature:        req.Temperature,
+			TopP:               req.TopP,
+			Metadata:           stlval.Ternary(req.Metadata != nil, req.Metadata, map[string]string{}),
+		},
+		reader: newChatReader(msgChan, chatReaderOptions{
+			MaxTokens:     req.MaxOutputTokens,
+			ReasoningMode: modelReasoningMode(turn.Model),
+			Tokenizer:     tokenizer.ForModel(turn.Model),
+			Abort:         turn.Abort,
+		}),
+	}
+	if req.Stream {
+		return createResponseWithStream(reqCtx, respCtx)
+	}
+	return createResponseNoStream(reqCtx, respCtx)
+}
+
+func createResponseNoStream(reqCtx echo.Context, respCtx *responsesContext) error {
+	reader := respCtx.reader
+	if _, err := reader.ReadAll(reqCtx.Request().Context()); err != nil {
+		return err
+	}
+	if reader.Reasoning.Len() > 0 {
+		respCtx.resp.Output = append(respCtx.resp.Output, &responsesOutputItem{
+			Type:    "reasoning",
+			ID:      newRandomID("rs_"),
+			Summary: []*responsesSummaryText{{Type: "summary_text", Text: reader.Reasoning.String()}},
+		})
+	}
+	respCtx.resp.Output = append(respCtx.resp.Output, newResponsesMessageItem(reader.Text.String()))
+	respCtx.complete(reqCtx)
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, respCtx.resp, "  "))
+}
+
+func createResponseWithStream(reqCtx echo.Context, respCtx *responsesContext) error {
+	writer := reqCtx.Response()
+	setSSEHeaders(writer)
+
+	var seq int
+	writeEvent := func(event string, data map[string]any) error {
+		data["type"] = event
+		data["sequence_number"] = seq
+		seq++
+		return writeSSEEvent(writer, event, data)
+	}
+
+	if err := writeEvent("response.created", map[string]any{"response": respCtx.resp}); err != nil {
+		return err
+	} else if err = writeEvent("response.in_progress", map[string]any{"response": respCtx.resp}); err != nil {
+		return err
+	}
+
+	// item 当前正在输出的输出项
+	var item *responsesOutputItem
+	closeItem := func() error {
+		if item == nil {
+			return nil
+		}
+		outputIndex := len(respCtx.resp.Output) - 1
+		var err error
+		switch item.Type {
+		case "reasoning":
+			item.Summary = []*responsesSummaryText{{Type: "summary_text", Text: respCtx.reader.Reasoning.String()}}
+			err = writeEvent("response.reasoning.done", map[string]any{"item_id": item.ID, "output_index": outputIndex, "text": item.Summary[0].Text})
+		case "message":
+			part := &responsesOutputContent{Type: "output_text", Text: respCtx.reader.Text.String(), Annotations: []any{}}
+			item.Status, item.Content = "completed", []*responsesOutputContent{part}
+			err = writeEvent("response.output_text.done", map[string]any{"item_id": item.ID, "output_index": outputIndex, "content_index": 0, "text": part.Text})
+			if err == nil {
+				err = writeEvent("response.content_part.done", map[string]any{"item_id": item.ID, "output_index": outputIndex, "content_index": 0, "part": part})
+			}
+		}
+		if err != nil {
+			return err
+		}
+		err = writeEvent("response.output_item.done", map[string]any{"output_index": outputIndex, "item": item})
+		item = nil
+		return err
+	}
+	openItem := func(itemType string) error {
+		if item != nil && item.Type == itemType {
+			return nil
+		} else if err := closeItem(); err != nil {
+			return err
+		}
+		switch itemType {
+		case "reasoning":
+			item = &responsesOutputItem{Type: itemType, ID: newRandomID("rs_"), Summary: []*responsesSummaryText{}}
+		case "message":
+			item = &responsesOutputItem{Type: itemType, ID: newRandomID("msg_"), Status: "in_progress", Role: openai.ChatMessageRoleAssistant, Content: []*responsesOutputContent{}}
+		}
+		respCtx.resp.Output = append(respCtx.resp.Output, item)
+		outputIndex := len(respCtx.resp.Output) - 1
+		err := writeEvent("response.output_item.added", map[string]any{"output_index": outputIndex, "item": item})
+		if err != nil || itemType != "message" {
+			return err
+		}
+		return writeEvent("response.content_part.added", map[string]any{
+			"item_id":       item.ID,
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"part":          &responsesOutputContent{Type: "output_text", Annotations: []any{}},
+		})
+	}
+
+	for {
+		event, err := respCtx.reader.Next(reqCtx.Request().Context())
+		if err != nil {
+			_, body := newOpenAIError(err)
+			_ = writeEvent("error", map[string]any{"code": stlval.DerefPtrOr(body.Code, body.Type), "message": body.Message, "param": body.Param})
+			return err
+		} else if event == nil {
+			break
+		}
+
+		switch event.Type {
+		case chatEventReasoning:
+			if err = openItem("reasoning"); err != nil {
+				return err
+			}
+			err = writeEvent("response.reasoning.delta", map[string]any{"item_id": item.ID, "output_index": len(respCtx.resp.Output) - 1, "delta": event.Text})
+		case chatEventText:
+			if err = openItem("message"); err != nil {
+				return err
+			}
+			err = writeEvent("response.output_text.delta", map[string]any{"item_id": item.ID, "output_index": len(respCtx.resp.Output) - 1, "content_index": 0, "delta": event.Text})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := openItem("message"); err != nil {
+		return err
+	} else if err = closeItem(); err != nil {
+		return err
+	}
+
+	respCtx.complete(reqCtx)
+	return writeEvent(stlval.Ternary(respCtx.resp.Status == "incomplete", "response.incomplete", "response.completed"), map[string]any{"response": respCtx.resp})
+}
+
+// complete 填写响应的最终状态，并保存响应以便后续请求接续
+func (respCtx *responsesContext) complete(reqCtx echo.Context) {
+	resp, reader := respCtx.resp, respCtx.reader
+	resp.Status = "completed"
+	if reader.FinishReason == chatFinishReasonLength {
+		resp.Status = "incomplete"
+		resp.IncompleteDetails = &responsesIncompleteDetails{Reason: "max_output_tokens"}
+	}
+	promptTokens := respCtx.historyTokens + respCtx.turn.PromptTokens()
+	resp.Usage = &responsesUsage{
+		InputTokens:         promptTokens,
+		OutputTokens:        reader.Tokens,
+		OutputTokensDetails: responsesOutputTokensInfo{ReasoningTokens: reader.ReasoningTokens()},
+		TotalTokens:         promptTokens + reader.Tokens,
+	}
+
+	reply := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reader.Text.String()}
+	if respCtx.req.PreviousResponseID == "" {
+		respCtx.turn.Save(respCtx.cli, reader, reply)
+	}
+	if !resp.Store {
+		return
+	}
+	// 被截断的回复在HuggingChat中保存的内容与响应不一致，只保存响应用于查询，不允许接续
+	var replyID string
+	if !reader.Truncated() {
+		var err error
+		replyID, err = respCtx.turn.ReplyMessageID(reqCtx.Request().Context(), respCtx.cli)
+		if err != nil {
+			_ = config.Logger.Error(err)
+			return
+		}
+	}
+	globalResponseStore.Set(resp.ID, &storedResponse{
+		Owner:          respCtx.owner,
+		Account:        hashString(respCtx.turn.account),
+		ConversationID: respCtx.turn.ConversationID,
+		MessageID:      replyID,
+		SystemPrompt:   respCtx.turn.SystemPrompt,
+		Response:       resp,
+	})
+}
+
+func newResponsesMessageItem(text string) *responsesOutputItem {
+	return &responsesOutputItem{
+		Type:    "message",
+		ID:      newRandomID("msg_"),
+		Status:  "completed",
+		Role:    openai.ChatMessageRoleAssistant,
+		Content: []*responsesOutputContent{{Type: "output_text", Text: text, Annotations: []any{}}},
+	}
+}
+
+func getResponse(reqCtx echo.Context) error {
+	authToken := strings.TrimPrefix(reqCtx.Request().Header.Get("Authorization"), "Bearer ")
+	if err := checkAuthorization(authToken); err != nil {
+		_ = config.Logger.Error(err)
+		return echo.ErrUnauthorized
+	}
+
+	stored, ok := globalResponseStore.Get(reqCtx.Param("id"))
+	if !ok || stored.Owner != hashString(authToken) {
+		return echo.NewHTTPError(http.StatusNotFound, "response not found")
+	}
+	return stlerr.ErrorWrap(reqCtx.JSONPretty(http.StatusOK, stored.Response, "  "))
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	stlerr "github.com/kkkunny/stl/error"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/config"
+)
+
+var (
+	sessionStorePath      = filepath.Join(config.DataDir, "sessions.json")
+	conversationStorePath = filepath.Join(config.DataDir, "conversations.json")
+	responseStorePath     = filepath.Join(config.DataDir, "responses.json")
+	fileStorePath         = filepath.Join(config.DataDir, "files.json")
+	fileStoreDir          = filepath.Join(config.DataDir, "files")
+)
+
+const (
+	sessionExpiration  = 7 * 24 * time.Hour
+	responseExpiration = 30 * 24 * time.Hour
+	fileExpiration     = 30 * 24 * time.Hour
+)
+
+var (
+	globalSessionStore      *fileStore[*chatSession]
+	globalConversationStore *fileStore[*systemConversation]
+	globalResponseStore     *fileStore[*storedResponse]
+	globalFileStore         *fileStore[*storedFile]
+)
+
+func init() {
+	globalSessionStore = newFileStore[*chatSession](sessionStorePath, sessionExpiration)
+	stlerr.Must(globalSessionStore.load())
+	globalConversationStore = newFileStore[*systemConversation](conversationStorePath, sessionExpiration)
+	stlerr.Must(globalConversationStore.load())
+	globalResponseStore = newFileStore[*storedResponse](responseStorePath, responseExpiration)
+	stlerr.Must(globalResponseStore.load())
+	globalFileStore = newFileStore[*storedFile](fileStorePath, fileExpiration)
+	globalFileStore.onExpire = func(_ string, file *storedFile) {
+		_ = os.Remove(file.Path())
+	}
+	stlerr.Must(globalFileStore.load())
+}
+
+// chatSession 对话历史对应的HuggingChat会话位置
+type chatSession struct {
+	ConversationID string `json:"conversation_id"`
+	MessageID      string `json:"message_id"`
+	ToolsHash      string `json:"tools_hash,omitempty"`
+}
+
+// systemConversation 按模型和系统提示词复用的HuggingChat会话
+type systemConversation struct {
+	ConversationID string `json:"conversation_id"`
+	RootMessageID  string `json:"root_message_id"`
+	Uses           int64  `json:"uses"`
+}
+
+// storedResponse 保存的Responses API响应及其对应的HuggingChat会话位置
+type storedResponse struct {
+	Owner          string           `json:"owner"`
+	Account        string           `json:"account,omitempty"` // 会话所属账号的凭证摘要
+	ConversationID string           `json:"conversation_id"`
+	MessageID      string           `json:"message_id,omitempty"` // 回复被截断时为空，不能被接续
+	SystemPrompt   string           `json:"system_prompt,omitempty"`
+	Response       *responsesObject `json:"response"`
+}
+
+// storedFile 通过Files API上传的文件，内容保存在fileStoreDir目录中
+type storedFile struct {
+	ID        string `json:"id"`
+	Owner     string `json:"owner"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	MIME      string `json:"mime"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func (file *storedFile) Path() string {
+	return filepath.Join(fileStoreDir, file.ID)
+}
+
+type fileStoreEntry[T any] struct {
+	Value     T         `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// fileStoreFlushDelay 修改后延迟写入文件的时间，期间的修改合并为一次写入
+const fileStoreFlushDelay = time.Second
+
+// fileStore 持久化到文件的键值存储，超过有效期未更新的条目会被丢弃
+type fileStore[T any] struct {
+	path       string
+	expiration time.Duration
+
+	lock     sync.RWMutex
+	data     map[string]*fileStoreEntry[T]
+	version  uint64 // 每次修改后递增，用于丢弃过时的写入
+	flushing bool   // 是否已经安排了写入
+
+	writeLock sync.Mutex
+	written   uint64 // 已写入文件的版本
+
+	onExpire func(key string, value T) // 条目过期被丢弃时调用
+}
+
+func newFileStore[T any](path string, expiration time.Duration) *fileStore[T] {
+	return &fileStore[T]{
+		path:       path,
+		expiration: expiration,
+		data:       make(map[string]*fileStoreEntry[T]),
+	}
+}
+
+func (store *fileStore[T]) load() error {
+	data, err := stlerr.ErrorWith(os.ReadFile(store.path))
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return stlerr.ErrorWrap(json.Unmarshal(data, &store.data))
+}
+
+// snapshot 丢弃过期条目并序列化当前数据，需要持有写锁
+func (store *fileStore[T]) snapshot() ([]byte, uint64, error) {
+	for key, entry := range store.data {
+		if time.Since(entry.UpdatedAt) > store.expiration {
+			delete(store.data, key)
+			if store.onExpire != nil {
+				store.onExpire(key, entry.Value)
+			}
+		}
+	}
+	data, err := stlerr.ErrorWith(json.Marshal(store.data))
+	return data, store.version, err
+}
+
+// markDirty 记录一次修改并安排在fileStoreFlushDelay后写入文件，需要持有写锁
+func (store *fileStore[T]) markDirty() {
+	store.version++
+	if store.flushing {
+		return
+	}
+	store.flushing = true
+	time.AfterFunc(fileStoreFlushDelay, store.flush)
+}
+
+// flush 将当前数据写入文件，失败时记录日志
+func (store *fileStore[T]) flush() {
+	store.lock.Lock()
+	store.flushing = false
+	data, version, err := store.snapshot()
+	store.lock.Unlock()
+	if err == nil {
+		err = store.write(data, version)
+	}
+	if err != nil {
+		_ = config.Logger.Error(err)
+	}
+}
+
+// write 将快照写入文件，写入串行进行，比已写入版本旧的快照会被跳过；
+// 先写入临时文件再重命名，避免中途失败时留下不完整的文件
+func (store *fileStore[T]) write(data []byte, version uint64) error {
+	store.writeLock.Lock()
+	defer store.writeLock.Unlock()
+
+	if version <= store.written {
+		return nil
+	}
+	dir := filepath.Dir(store.path)
+	if err := stlerr.ErrorWrap(os.MkdirAll(dir, 0750)); err != nil {
+		return err
+	}
+	file, err := stlerr.ErrorWith(os.CreateTemp(dir, filepath.Base(store.path)+".*.tmp"))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err = stlerr.ErrorWith(file.Write(data)); err != nil {
+		_ = file.Close()
+		return err
+	} else if err = stlerr.ErrorWrap(file.Sync()); err != nil {
+		_ = file.Close()
+		return err
+	} else if err = stlerr.ErrorWrap(file.Close()); err != nil {
+		return err
+	} else if err = stlerr.ErrorWrap(os.Rename(file.Name(), store.path)); err != nil {
+		return err
+	}
+	store.written = version
+	return nil
+}
+
+func (store *fileStore[T]) Get(key string) (T, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	entry, ok := store.data[key]
+	if !ok || time.Since(entry.UpdatedAt) > store.expiration {
+		var zero T
+		return zero, false
+	}
+	return entry.Value, true
+}
+
+func (store *fileStore[T]) Set(key string, value T) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.data[key] = &fileStoreEntry[T]{Value: value, UpdatedAt: time.Now()}
+	store.markDirty()
+}
+
+// Update 原子地将未过期的条目替换为f的返回值，条目不存在时不调用f并返回false
+func (store *fileStore[T]) Update(key string, f func(value T) T) (T, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	entry, ok := store.data[key]
+	if !ok || time.Since(entry.UpdatedAt) > store.expiration {
+		var zero T
+		return zero, false
+	}
+	value := f(entry.Value)
+	store.data[key] = &fileStoreEntry[T]{Value: value, UpdatedAt: time.Now()}
+	store.markDirty()
+	return value, true
+}
+
+// Range 遍历未过期的条目
+func (store *fileStore[T]) Range(f func(key string, value T) bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for key, entry := range store.data {
+		if time.Since(entry.UpdatedAt) > store.expiration {
+			continue
+		}
+		if !f(key, entry.Value) {
+			return
+		}
+	}
+}
+
+func (store *fileStore[T]) Delete(key string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.data[key]; !ok {
+		return
+	}
+	delete(store.data, key)
+	store.markDirty()
+}
+
+// sessionKey 根据凭证、模型和消息历史计算会话键
+func sessionKey(owner string, model string, msgs []openai.ChatCompletionMessage, files chatFileParts) string {
+	hash := sha256.New()
+	hash.Write([]byte(owner))
+	hash.Write([]byte{0})
+	hash.Write([]byte(model))
+	for _, msg := range msgs {
+		hash.Write([]byte{0})
+		hash.Write([]byte(msg.Role))
+		hash.Write([]byte{0})
+		hash.Write([]byte(normalizeMessageForSession(msg, files)))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// conversationKey 根据凭证、模型和系统提示词计算复用会话的键
+func conversationKey(owner string, model string, systemPrompt string) string {
+	return hashString(strings.Join([]string{owner, model, systemPrompt}, "\x00"))
+}
+
+func normalizeMessageForSession(msg openai.ChatCompletionMessage, files chatFileParts) string {
+	text := messageText(msg)
+	if msg.Role == openai.ChatMessageRoleAssistant {
+		// inline方式输出的推理内容可能被客户端保留或删除，都视为同一条消息
+		text = stripThinkBlocks(text)
+	}
+	for i, part := range msg.MultiContent {
+		switch {
+		case part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil:
+			text += "\n" + hashString(part.ImageURL.URL)
+		case part.Type == chatMessagePartTypeFile:
+			text += "\n" + files.Get(&msg.MultiContent[i]).Hash()
+		}
+	}
+	if len(msg.ToolCalls) > 0 {
+		text += "\n" + formatToolCalls(msg.ToolCalls)
+	}
+	if msg.ToolCallID != "" {
+		text = msg.ToolCallID + "\n" + text
+	}
+	return strings.TrimSpace(text)
+}
+
+// hashString 计算字符串摘要
+func hashString(s string) string {
+	if s == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
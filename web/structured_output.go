@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	stlerr "github.com/kkkunny/stl/error"
+	stlval "github.com/kkkunny/stl/value"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/hugchat"
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+)
+
+// structuredOutputMaxRetries 结构化输出校验失败后的最大重试次数
+const structuredOutputMaxRetries = 2
+
+var jsonCodeBlockRegexp = regexp.MustCompile("(?s)```(?:json)?\\s*(.*?)\\s*```")
+
+type responseFormatJSONSchema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      bool            `json:"strict"`
+}
+
+// responseFormat 替代openai.ChatCompletionResponseFormat，后者的schema无法反序列化
+type responseFormat struct {
+	Type       openai.ChatCompletionResponseFormatType `json:"type,omitempty"`
+	JSONSchema *responseFormatJSONSchema               `json:"json_schema,omitempty"`
+}
+
+// structuredOutputOptions 结构化输出参数
+type structuredOutputOptions struct {
+	Type   openai.ChatCompletionResponseFormatType
+	Name   string
+	Schema map[string]any
+}
+
+func newStructuredOutputOptions(format *responseFormat) (*structuredOutputOptions, error) {
+	if format == nil {
+		return nil, nil
+	}
+	switch format.Type {
+	case openai.ChatCompletionResponseFormatTypeJSONObject:
+		return &structuredOutputOptions{Type: format.Type}, nil
+	case openai.ChatCompletionResponseFormatTypeJSONSchema:
+		if format.JSONSchema == nil || len(format.JSONSchema.Schema) == 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "response_format.json_schema.schema is required")
+		}
+		var schema map[string]any
+		if err := json.Unmarshal(format.JSONSchema.Schema, &schema); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "response_format.json_schema.schema must be a JSON object")
+		}
+		return &structuredOutputOptions{Type: format.Type, Name: format.JSONSchema.Name, Schema: schema}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Prompt 生成约束模型输出格式的提示词
+func (opts *structuredOutputOptions) Prompt() string {
+	if opts.Type == openai.ChatCompletionResponseFormatTypeJSONObject {
+		return "Respond ONLY with a single valid JSON object. Do not wrap it in markdown code blocks and do not add any explanation."
+	}
+	schema, _ := json.Marshal(opts.Schema)
+	return fmt.Sprintf("Respond ONLY with a single valid JSON value that conforms to the following JSON schema named `%s`. Do not wrap it in markdown code blocks and do not add any explanation.\nJSON schema:\n%s", opts.Name, schema)
+}
+
+// Validate 从模型回复中提取并校验JSON，返回规范化后的JSON文本
+func (opts *structuredOutputOptions) Validate(text string) (string, error) {
+	data, raw, err := extractJSON(text)
+	if err != nil {
+		return "", err
+	}
+	if opts.Type == openai.ChatCompletionResponseFormatTypeJSONObject {
+		if _, ok := data.(map[string]any); !ok {
+			return "", stlerr.Errorf("expected a JSON object")
+		}
+		return raw, nil
+	}
+	if err = validateJSONSchema(opts.Schema, opts.Schema, data, "$"); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// extractJSON 从文本中提取JSON，兼容markdown代码块和前后的说明文字
+func extractJSON(text string) (any, string, error) {
+	candidates := []string{strings.TrimSpace(text)}
+	for _, match := range jsonCodeBlockRegexp.FindAllStringSubmatch(text, -1) {
+		candidates = append(candidates, match[1])
+	}
+	if start := strings.IndexAny(text, "{["); start >= 0 {
+		if end := strings.LastIndexAny(text, "}]"); end > start {
+			candidates = append(candidates, text[start:end+1])
+		}
+	}
+
+	for _, candidate := range candidates {
+		var data any
+		if json.Unmarshal([]byte(candidate), &data) == nil {
+			return data, strings.TrimSpace(candidate), nil
+		}
+	}
+	return nil, "", stlerr.Errorf("reply is not valid JSON")
+}
+
+func validateJSONSchema(root, schema map[string]any, data any, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, ok := resolveJSONSchemaRef(root, ref)
+		if !ok {
+			return stlerr.Errorf("%s: unresolvable $ref `%s`", path, ref)
+		}
+		return validateJSONSchema(root, resolved, data, path)
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if subs, ok := schema[key].([]any); ok {
+			if !stlslices.Any(subs, func(_ int, sub any) bool {
+				subSchema, ok := sub.(map[string]any)
+				return ok && validateJSONSchema(root, subSchema, data, path) == nil
+			}) {
+				return stlerr.Errorf("%s: does not match any schema in %s", path, key)
+			}
+		}
+	}
+	if subs, ok := schema["allOf"].([]any); ok {
+		for _, sub := range subs {
+			if subSchema, ok := sub.(map[string]any); ok {
+				if err := validateJSONSchema(root, subSchema, data, path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if constVal, ok := schema["const"]; ok && !jsonEqual(constVal, data) {
+		return stlerr.Errorf("%s: must be %v", path, constVal)
+	}
+	if enum, ok := schema["enum"].([]any); ok && !stlslices.Any(enum, func(_ int, e any) bool { return jsonEqual(e, data) }) {
+		return stlerr.Errorf("%s: must be one of %v", path, enum)
+	}
+
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		types = stlslices.Map(t, func(_ int, e any) string {
+			str, _ := e.(string)
+			return str
+		})
+	}
+	if len(types) > 0 && !stlslices.Any(types, func(_ int, t string) bool { return jsonTypeMatch(t, data) }) {
+		return stlerr.Errorf("%s: expected %s", path, strings.Join(types, " or "))
+	}
+
+	switch value := data.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, field := range required {
+				name, _ := field.(string)
+				if _, exist := value[name]; !exist {
+					return stlerr.Errorf("%s: missing required property `%s`", path, name)
+				}
+			}
+		}
+		for name, fieldValue := range value {
+			fieldSchema, ok := props[name].(map[string]any)
+			if !ok {
+				switch additional := schema["additionalProperties"].(type) {
+				case bool:
+					if !additional {
+						return stlerr.Errorf("%s: unexpected property `%s`", path, name)
+					}
+				case map[string]any:
+					fieldSchema = additional
+				}
+			}
+			if fieldSchema == nil {
+				continue
+			}
+			if err := validateJSONSchema(root, fieldSchema, fieldValue, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if minItems, ok := schema["minItems"].(float64); ok && float64(len(value)) < minItems {
+			return stlerr.Errorf("%s: expected at least %d items", path, int(minItems))
+		}
+		if maxItems, ok := schema["maxItems"].(float64); ok && float64(len(value)) > maxItems {
+			return stlerr.Errorf("%s: expected at most %d items", path, int(maxItems))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range value {
+				if err := validateJSONSchema(root, items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func resolveJSONSchemaRef(root map[string]any, ref string) (map[string]any, bool) {
+	if ref == "#" {
+		return root, true
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	var cur any = root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		cur = obj[strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")]
+	}
+	res, ok := cur.(map[string]any)
+	return res, ok
+}
+
+func jsonTypeMatch(t string, data any) bool {
+	switch t {
+	case "object":
+		return stlval.Is[map[string]any](data)
+	case "array":
+		return stlval.Is[[]any](data)
+	case "string":
+		return stlval.Is[string](data)
+	case "number":
+		return stlval.Is[float64](data)
+	case "integer":
+		num, ok := data.(float64)
+		return ok && num == math.Trunc(num)
+	case "boolean":
+		return stlval.Is[bool](data)
+	case "null":
+		return data == nil
+	default:
+		return true
+	}
+}
+
+func jsonEqual(l, r any) bool {
+	ld, _ := json.Marshal(l)
+	rd, _ := json.Marshal(r)
+	return string(ld) == string(rd)
+}
+
+// generateStructuredOutput 读取完整回复并校验，失败时通过重试让模型重新生成，成功后回放为新的消息流
+func generateStructuredOutput(ctx context.Context, cli *hugchat.Client, turn *chatTurn, params *hugchat.ChatConversationParams, opts *structuredOutputOptions, msgChan chan *dto.StreamMessage) (chan *dto.StreamMessage, error) {
+	for retry := 0; ; retry++ {
+		var msgs []*dto.StreamMessage
+		var text string
+		for msg := range msgChan {
+			switch msg.Type {
+			case dto.StreamMessageTypeError:
+				return nil, msg.Error
+			case dto.StreamMessageTypeFinalAnswer:
+				text = stlval.DerefPtrOr(msg.Text)
+			case dto.StreamMessageTypeStream:
+			default:
+				msgs = append(msgs, msg)
+			}
+		}
+
+		reply, validErr := opts.Validate(text)
+		if validErr == nil {
+			replay := make(chan *dto.StreamMessage, len(msgs)+2)
+			for _, msg := range msgs {
+				replay <- msg
+			}
+			replay <- &dto.StreamMessage{Type: dto.StreamMessageTypeStream, Token: &reply}
+			replay <- &dto.StreamMessage{Type: dto.StreamMessageTypeFinalAnswer, Text: &reply}
+			close(replay)
+			return replay, nil
+		} else if retry >= structuredOutputMaxRetries {
+			return nil, echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("model output does not match response_format: %s", validErr.Error()))
+		}
+
+		if turn.UserMessageID == "" {
+			return nil, stlerr.Errorf("not found message to retry, parent=%s", params.LastMsgID)
+		}
+		var err error
+		msgChan, err = cli.ChatConversation(ctx, turn.ConversationID, &hugchat.ChatConversationParams{
+			LastMsgID: turn.UserMessageID,
+			Inputs:    fmt.Sprintf("%s\n\n(Your previous reply was rejected: %s. %s)", params.Inputs, validErr.Error(), opts.Prompt()),
+			IsRetry:   true,
+			WebSearch: params.WebSearch,
+			Tools:     params.Tools,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
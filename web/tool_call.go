@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	stlslices "github.com/kkkunny/stl/container/slices"
+	"github.com/labstack/echo/v4"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	toolCallStartTag = "<tool_call>"
+	toolCallEndTag   = "</tool_call>"
+)
+
+var toolCallRegexp = regexp.MustCompile(`(?s)<tool_call>\s*(.*?)\s*(?:</tool_call>|$)`)
+
+type toolChoiceMode string
+
+const (
+	toolChoiceModeNone     toolChoiceMode = "none"
+	toolChoiceModeAuto     toolChoiceMode = "auto"
+	toolChoiceModeRequired toolChoiceMode = "required"
+	toolChoiceModeFunction toolChoiceMode = "function"
+)
+
+// toolCallOptions 工具调用模拟参数
+type toolCallOptions struct {
+	Mode     toolChoiceMode
+	Function string
+	Tools    []openai.Tool
+}
+
+func newToolCallOptions(req *openai.ChatCompletionRequest) (*toolCallOptions, error) {
+	tools := stlslices.Filter(req.Tools, func(_ int, tool openai.Tool) bool {
+		return tool.Type == openai.ToolTypeFunction && tool.Function != nil
+	})
+	opts := &toolCallOptions{Mode: toolChoiceModeAuto, Tools: tools}
+
+	switch choice := req.ToolChoice.(type) {
+	case string:
+		switch toolChoiceMode(choice) {
+		case toolChoiceModeNone, toolChoiceModeRequired:
+			opts.Mode = toolChoiceMode(choice)
+		}
+	case map[string]any:
+		if fn, ok := choice["function"].(map[string]any); ok {
+			if name, ok := fn["name"].(string); ok && name != "" {
+				opts.Mode, opts.Function = toolChoiceModeFunction, name
+			}
+		}
+	}
+
+	if opts.Mode == toolChoiceModeFunction {
+		opts.Tools = stlslices.Filter(opts.Tools, func(_ int, tool openai.Tool) bool {
+			return tool.Function.Name == opts.Function
+		})
+		if len(opts.Tools) == 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tool_choice function `%s` is not in tools", opts.Function))
+		}
+	}
+	if len(opts.Tools) == 0 {
+		opts.Mode = toolChoiceModeNone
+	}
+	return opts, nil
+}
+
+// Enabled 是否需要模拟工具调用
+func (opts *toolCallOptions) Enabled() bool {
+	return opts.Mode != toolChoiceModeNone
+}
+
+// Prompt 将工具定义渲染为提示词
+func (opts *toolCallOptions) Prompt() string {
+	if !opts.Enabled() {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("# Tools\n\n")
+	builder.WriteString("You may call one or more functions to assist with the user query.\n")
+	builder.WriteString("You are provided with function signatures within <tools></tools> XML tags:\n<tools>\n")
+	for _, tool := range opts.Tools {
+		data, _ := json.Marshal(tool)
+		builder.Write(data)
+		builder.WriteString("\n")
+	}
+	builder.WriteString("</tools>\n\n")
+	builder.WriteString("For each function call, return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n")
+	builder.WriteString("<tool_call>\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n</tool_call>\n")
+	builder.WriteString("Multiple <tool_call> blocks may be returned to call functions in parallel. Do not write anything after the last </tool_call>.\n")
+	builder.WriteString("Results of function calls are given back as <tool_response></tool_response> blocks.\n")
+
+	switch opts.Mode {
+	case toolChoiceModeRequired:
+		builder.WriteString("You MUST call at least one function in your reply.\n")
+	case toolChoiceModeFunction:
+		builder.WriteString(fmt.Sprintf("You MUST call the function `%s` in your reply.\n", opts.Function))
+	}
+	return builder.String()
+}
+
+// formatToolCalls 将助手历史中的工具调用渲染为文本
+func formatToolCalls(calls []openai.ToolCall) string {
+	blocks := stlslices.Map(calls, func(_ int, call openai.ToolCall) string {
+		args := strings.TrimSpace(call.Function.Arguments)
+		if args == "" || !json.Valid([]byte(args)) {
+			args = "{}"
+		}
+		return fmt.Sprintf("%s\n{\"name\": %q, \"arguments\": %s}\n%s", toolCallStartTag, call.Function.Name, args, toolCallEndTag)
+	})
+	return strings.Join(blocks, "\n")
+}
+
+// formatToolResponse 将工具执行结果渲染为文本
+func formatToolResponse(msg openai.ChatCompletionMessage) string {
+	return fmt.Sprintf("<tool_response id=%q name=%q>\n%s\n</tool_response>", msg.ToolCallID, msg.Name, msg.Content)
+}
+
+type rawToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// parseToolCalls 从模型回复中解析工具调用，返回剩余的文本内容
+func parseToolCalls(text string) (string, []openai.ToolCall) {
+	start := strings.Index(text, toolCallStartTag)
+	if start < 0 {
+		return text, nil
+	}
+
+	var calls []openai.ToolCall
+	for _, match := range toolCallRegexp.FindAllStringSubmatch(text[start:], -1) {
+		body := strings.TrimSpace(match[1])
+		body = strings.TrimPrefix(strings.TrimPrefix(body, "```json"), "```")
+		body = strings.TrimSpace(strings.TrimSuffix(body, "```"))
+
+		var raw rawToolCall
+		if err := json.Unmarshal([]byte(body), &raw); err != nil || raw.Name == "" {
+			continue
+		}
+		args := "{}"
+		if len(raw.Arguments) > 0 {
+			var strArgs string
+			if json.Unmarshal(raw.Arguments, &strArgs) == nil {
+				args = strArgs
+			} else {
+				args = string(raw.Arguments)
+			}
+		}
+		calls = append(calls, openai.ToolCall{
+			ID:   newRandomID("call_"),
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      raw.Name,
+				Arguments: args,
+			},
+		})
+	}
+	if len(calls) == 0 {
+		return text, nil
+	}
+	return strings.TrimSpace(text[:start]), calls
+}
+
+// toolCallStreamParser 流式输出时拦截工具调用文本
+type toolCallStreamParser struct {
+	enabled bool
+	buffer  strings.Builder
+	emitted int
+	inCall  bool
+}
+
+func newToolCallStreamParser(opts *toolCallOptions) *toolCallStreamParser {
+	return &toolCallStreamParser{enabled: opts.Enabled()}
+}
+
+// Feed 输入新的token，返回可以直接输出的文本
+func (p *toolCallStreamParser) Feed(token string) string {
+	if !p.enabled {
+		return token
+	}
+	p.buffer.WriteString(token)
+	if p.inCall {
+		return ""
+	}
+
+	text := p.buffer.String()
+	pending := text[p.emitted:]
+	if idx := strings.Index(pending, toolCallStartTag); idx >= 0 {
+		p.inCall = true
+		p.emitted = len(text)
+		return pending[:idx]
+	}
+
+	keep := 0
+	for i := min(len(pending), len(toolCallStartTag)-1); i > 0; i-- {
+		if strings.HasSuffix(pending, toolCallStartTag[:i]) {
+			keep = i
+			break
+		}
+	}
+	p.emitted += len(pending) - keep
+	return pending[:len(pending)-keep]
+}
+
+// Finish 结束输入，返回剩余文本和解析出的工具调用
+func (p *toolCallStreamParser) Finish() (string, []openai.ToolCall) {
+	if !p.enabled {
+		return "", nil
+	}
+	text := p.buffer.String()
+	if !p.inCall {
+		return text[p.emitted:], nil
+	}
+	_, calls := parseToolCalls(text)
+	if len(calls) == 0 {
+		start := strings.Index(text, toolCallStartTag)
+		return text[start:], nil
+	}
+	return "", calls
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/sashabaranov/go-openai"
+
+	"github.com/kkkunny/HuggingChatAPI/internal/tokenizer"
+)
+
+// countMessagesTokens 计算消息列表作为提示词的token数，每条消息额外计入角色和分隔符，extra为额外拼接到提示词中的文本
+func countMessagesTokens(tok tokenizer.Tokenizer, msgs []openai.ChatCompletionMessage, extra ...string) int {
+	count := 3
+	for _, msg := range msgs {
+		count += 3 + tokenizer.Count(tok, msg.Role) + tokenizer.Count(tok, messageText(msg))
+		if msg.Name != "" {
+			count += 1 + tokenizer.Count(tok, msg.Name)
+		}
+		if len(msg.ToolCalls) > 0 {
+			count += tokenizer.Count(tok, formatToolCalls(msg.ToolCalls))
+		}
+	}
+	for _, text := range extra {
+		count += tokenizer.Count(tok, text)
+	}
+	return count
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"regexp"
 
 	stlerr "github.com/kkkunny/stl/error"
+	"github.com/labstack/echo/v4"
 
 	"github.com/kkkunny/HuggingChatAPI/hugchat"
 )
@@ -20,3 +25,82 @@ func parseAuthorization(token string) (hugchat.TokenProvider, error) {
 	}
 	return hugchat.NewDirectTokenProvider(token), nil
 }
+
+// stringList 可以是单个字符串或字符串列表的字段
+type stringList []string
+
+func (list *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*list = stringList{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(data, &ss); err != nil {
+		return err
+	}
+	*list = ss
+	return nil
+}
+
+// newRandomID 生成带前缀的随机ID
+func newRandomID(prefix string) string {
+	data := make([]byte, 12)
+	_, _ = rand.Read(data)
+	return prefix + hex.EncodeToString(data)
+}
+
+// writeSSEData 写入一条SSE数据
+func writeSSEData(writer *echo.Response, v any) error {
+	data, err := stlerr.ErrorWith(json.Marshal(v))
+	if err != nil {
+		return err
+	}
+	return writeSSERaw(writer, string(data))
+}
+
+// writeSSERaw 写入一条原始SSE数据
+func writeSSERaw(writer *echo.Response, data string) error {
+	_, err := stlerr.ErrorWith(fmt.Fprint(writer, "data: "+data+"\n\n"))
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return nil
+}
+
+// writeSSEEvent 写入一条带事件名的SSE数据
+func writeSSEEvent(writer *echo.Response, event string, v any) error {
+	data, err := stlerr.ErrorWith(json.Marshal(v))
+	if err != nil {
+		return err
+	}
+	_, err = stlerr.ErrorWith(fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event, data))
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return nil
+}
+
+// setSSEHeaders 设置SSE响应头
+func setSSEHeaders(writer *echo.Response) {
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.Header().Set("Transfer-Encoding", "chunked")
+}
+
+// writeNDJSON 写入一行JSON数据
+func writeNDJSON(writer *echo.Response, v any) error {
+	data, err := stlerr.ErrorWith(json.Marshal(v))
+	if err != nil {
+		return err
+	}
+	_, err = stlerr.ErrorWith(writer.Write(append(data, '\n')))
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kkkunny/HuggingChatAPI/hugchat/dto"
+)
+
+type urlCitation struct {
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+}
+
+type messageAnnotation struct {
+	Type        string       `json:"type"`
+	URLCitation *urlCitation `json:"url_citation"`
+}
+
+// buildURLCitations 根据网络搜索来源生成url_citation注释，
+// 回复中出现[n]引用标记时注释指向标记的位置，否则指向整个回复
+func buildURLCitations(text string, sources []*dto.WebSearchSource) []*messageAnnotation {
+	annotations := make([]*messageAnnotation, 0, len(sources))
+	for i, source := range sources {
+		if source == nil || source.Link == "" {
+			continue
+		}
+		title := source.Title
+		if title == "" {
+			title = source.Hostname
+		}
+
+		marker := fmt.Sprintf("[%d]", i+1)
+		found := false
+		for offset := 0; ; {
+			idx := strings.Index(text[offset:], marker)
+			if idx < 0 {
+				break
+			}
+			start := utf8.RuneCountInString(text[:offset+idx])
+			annotations = append(annotations, &messageAnnotation{
+				Type: "url_citation",
+				URLCitation: &urlCitation{
+					StartIndex: start,
+					EndIndex:   start + len(marker),
+					URL:        source.Link,
+					Title:      title,
+				},
+			})
+			offset += idx + len(marker)
+			found = true
+		}
+		if !found {
+			annotations = append(annotations, &messageAnnotation{
+				Type: "url_citation",
+				URLCitation: &urlCitation{
+					StartIndex: 0,
+					EndIndex:   utf8.RuneCountInString(text),
+					URL:        source.Link,
+					Title:      title,
+				},
+			})
+		}
+	}
+	return annotations
+}